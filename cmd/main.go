@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/m-adawi/swarm-cd/swarmcd"
 	"github.com/m-adawi/swarm-cd/util"
@@ -17,10 +21,41 @@ func init() {
 }
 
 func main() {
-	go swarmcd.Run()
-	if err := web.RunServer(util.Configs.Address); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go swarmcd.Run(ctx)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- web.RunServer(util.Configs.Address)
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case <-ctx.Done():
+	}
+
+	util.Logger.Info("shutting down")
+	gracePeriod := time.Duration(util.Configs.ShutdownGracePeriod) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err := web.Shutdown(shutdownCtx)
+	if err != nil {
+		util.Logger.Error(fmt.Sprintf("could not shut down web server: %s", err))
+	}
+	err = swarmcd.Shutdown(shutdownCtx)
+	if err != nil {
+		util.Logger.Error(fmt.Sprintf("could not shut down gracefully: %s", err))
+	}
+	// spans are flushed even after the grace period
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelTracing()
+	err = swarmcd.ShutdownTracing(tracingCtx)
+	if err != nil {
+		util.Logger.Error(fmt.Sprintf("could not export remaining spans: %s", err))
 	}
 }
 
@@ -0,0 +1,136 @@
+package swarmcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+const (
+	commitStatePending = "pending"
+	commitStateSuccess = "success"
+	commitStateFailure = "failure"
+)
+
+// commitStatusReporter posts the deploy status of
+// commits back to the git provider hosting the repo
+type commitStatusReporter struct {
+	provider string
+	apiURL   string
+	token    string
+	// owner/repo on GitHub and Gitea, group/project on GitLab
+	project string
+}
+
+func newCommitStatusReporter(repoName string, repoURL string, statusConfig *util.CommitStatusConfig) (*commitStatusReporter, error) {
+	parsedURL, err := url.Parse(repoURL)
+	if err != nil || parsedURL.Host == "" {
+		return nil, fmt.Errorf("could not parse url of repo %s to report commit statuses", repoName)
+	}
+	reporter := &commitStatusReporter{
+		provider: statusConfig.Provider,
+		apiURL:   strings.TrimSuffix(statusConfig.ApiUrl, "/"),
+		token:    statusConfig.Token,
+		project:  strings.TrimSuffix(strings.Trim(parsedURL.Path, "/"), ".git"),
+	}
+	if statusConfig.TokenFile != "" {
+		tokenBytes, err := os.ReadFile(statusConfig.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read token file %s for repo %s", statusConfig.TokenFile, repoName)
+		}
+		reporter.token = strings.TrimSpace(string(tokenBytes))
+	}
+	if reporter.token == "" {
+		return nil, fmt.Errorf("you must set one of token or token_file to report commit statuses of repo %s", repoName)
+	}
+
+	// default to the API of the server hosting the repo
+	serverURL := parsedURL.Scheme + "://" + parsedURL.Host
+	switch reporter.provider {
+	case "github":
+		if reporter.apiURL == "" && parsedURL.Host == "github.com" {
+			reporter.apiURL = "https://api.github.com"
+		} else if reporter.apiURL == "" {
+			reporter.apiURL = serverURL + "/api/v3"
+		}
+	case "gitlab":
+		if reporter.apiURL == "" {
+			reporter.apiURL = serverURL + "/api/v4"
+		}
+	case "gitea":
+		if reporter.apiURL == "" {
+			reporter.apiURL = serverURL + "/api/v1"
+		}
+	default:
+		return nil, fmt.Errorf("unknown commit status provider %s for repo %s", reporter.provider, repoName)
+	}
+	return reporter, nil
+}
+
+func (reporter *commitStatusReporter) report(commitHash string, stackName string, state string, description string) error {
+	statusContext := "swarm-cd/" + stackName
+	var targetURL string
+	if config.ExternalUrl != "" {
+		targetURL = strings.TrimSuffix(config.ExternalUrl, "/") + "/stacks/" + stackName
+	}
+
+	var statusURL string
+	var headers map[string]string
+	var status map[string]string
+	switch reporter.provider {
+	case "gitlab":
+		if state == commitStateFailure {
+			state = "failed"
+		}
+		statusURL = fmt.Sprintf("%s/projects/%s/statuses/%s", reporter.apiURL, url.PathEscape(reporter.project), commitHash)
+		headers = map[string]string{"PRIVATE-TOKEN": reporter.token}
+		status = map[string]string{"state": state, "name": statusContext, "description": description, "target_url": targetURL}
+	case "gitea":
+		statusURL = fmt.Sprintf("%s/repos/%s/statuses/%s", reporter.apiURL, reporter.project, commitHash)
+		headers = map[string]string{"Authorization": "token " + reporter.token}
+		status = map[string]string{"state": state, "context": statusContext, "description": description, "target_url": targetURL}
+	default:
+		statusURL = fmt.Sprintf("%s/repos/%s/statuses/%s", reporter.apiURL, reporter.project, commitHash)
+		headers = map[string]string{"Authorization": "Bearer " + reporter.token, "Accept": "application/vnd.github+json"}
+		status = map[string]string{"state": state, "context": statusContext, "description": description, "target_url": targetURL}
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	err = postJSON(statusURL, headers, body)
+	if err != nil {
+		return fmt.Errorf("could not report %s status of commit %s: %w", state, commitHash, err)
+	}
+	return nil
+}
+
+// reportCommitStatus reports the status of the deployed commit if the
+// stack repo is configured to. Polls redeploy the same commit over and
+// over, so once a commit status is reported, pending is not reported
+// again for that commit and neither is the same status
+func (swarmStack *swarmStack) reportCommitStatus(commitHash string, state string, description string) {
+	reporter := swarmStack.repo.commitStatus
+	if reporter == nil || commitHash == "" {
+		return
+	}
+	if swarmStack.lastCommitStatus.commitHash == commitHash &&
+		(state == commitStatePending || state == swarmStack.lastCommitStatus.state) {
+		return
+	}
+	// providers reject long descriptions
+	if len(description) > 140 {
+		description = description[:137] + "..."
+	}
+	err := reporter.report(commitHash, swarmStack.name, state, description)
+	if err != nil {
+		logger.Error(err.Error(), "stack", swarmStack.name)
+		return
+	}
+	swarmStack.lastCommitStatus.commitHash = commitHash
+	swarmStack.lastCommitStatus.state = state
+}
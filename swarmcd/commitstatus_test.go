@@ -0,0 +1,60 @@
+package swarmcd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// Statuses are posted to the provider API of the repo project
+func TestReportCommitStatus(t *testing.T) {
+	tests := []struct {
+		provider    string
+		repoURL     string
+		wantPath    string
+		wantHeader  string
+		wantState   string
+		wantContext string
+	}{
+		{"github", "https://github.com/user/repo.git", "/repos/user/repo/statuses/abc123", "Authorization", "failure", "context"},
+		{"gitlab", "https://gitlab.com/group/sub/repo.git", "/projects/group%2Fsub%2Frepo/statuses/abc123", "PRIVATE-TOKEN", "failed", "name"},
+		{"gitea", "https://gitea.example.com/user/repo", "/repos/user/repo/statuses/abc123", "Authorization", "failure", "context"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			var gotPath, gotHeader string
+			var gotStatus map[string]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.EscapedPath()
+				gotHeader = r.Header.Get(tt.wantHeader)
+				json.NewDecoder(r.Body).Decode(&gotStatus)
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer server.Close()
+			reporter, err := newCommitStatusReporter("test", tt.repoURL, &util.CommitStatusConfig{
+				Provider: tt.provider,
+				ApiUrl:   server.URL,
+				Token:    "secret",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			err = reporter.report("abc123", "app", commitStateFailure, "boom")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("unexpected path: %s", gotPath)
+			}
+			if gotHeader == "" {
+				t.Errorf("missing %s header", tt.wantHeader)
+			}
+			if gotStatus["state"] != tt.wantState || gotStatus[tt.wantContext] != "swarm-cd/app" {
+				t.Errorf("unexpected status: %v", gotStatus)
+			}
+		})
+	}
+}
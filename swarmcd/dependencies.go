@@ -0,0 +1,71 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/cli/cli/compose/convert"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// blockingDeploy returns why the stack must not be deployed now, or
+// an empty string if it can be. Overrides are never blocked
+func (swarmStack *swarmStack) blockingDeploy(ctx context.Context, trigger Trigger) string {
+	if trigger == TriggerOverride {
+		return ""
+	}
+	if reason := swarmStack.blockingSyncWindow(trigger, time.Now()); reason != "" {
+		return reason
+	}
+	return swarmStack.blockingDependency(ctx)
+}
+
+// blockingDependency returns why a stack the stack depends on is not
+// ready, or an empty string if all of them are. Dependencies that were
+// never deployed have no services, so their health tells nothing
+func (swarmStack *swarmStack) blockingDependency(ctx context.Context) string {
+	for _, dependency := range swarmStack.dependsOn {
+		status := getStackStatus(dependency.name)
+		switch {
+		case status.Status == StatusUnknown || status.Revision == "" || status.composeHash == "":
+			return fmt.Sprintf("dependency %s is not deployed yet", dependency.name)
+		case status.Status == StatusFailed:
+			return fmt.Sprintf("dependency %s failed to sync", dependency.name)
+		case status.Status == StatusOutOfSync:
+			return fmt.Sprintf("dependency %s is out of sync: %s", dependency.name, status.Reason)
+		}
+		reason, err := unhealthyServices(ctx, dependency.name)
+		if err != nil {
+			return fmt.Sprintf("could not check health of dependency %s: %s", dependency.name, err)
+		}
+		if reason != "" {
+			return fmt.Sprintf("dependency %s is unhealthy: %s", dependency.name, reason)
+		}
+	}
+	return ""
+}
+
+// unhealthyServices returns the first service of the stack
+// that does not run all its replicas, if any
+func unhealthyServices(ctx context.Context, stackName string) (string, error) {
+	services, err := dockerCli.Client().ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", convert.LabelNamespace+"="+stackName)),
+		Status:  true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not list services of stack %s: %w", stackName, err)
+	}
+	for _, service := range services {
+		// jobs complete instead of running
+		if service.Spec.Mode.ReplicatedJob != nil || service.Spec.Mode.GlobalJob != nil {
+			continue
+		}
+		status := service.ServiceStatus
+		if status != nil && status.RunningTasks < status.DesiredTasks {
+			return fmt.Sprintf("service %s runs %d of %d replicas", service.Spec.Name, status.RunningTasks, status.DesiredTasks), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,38 @@
+package swarmcd
+
+import (
+	"context"
+	"testing"
+)
+
+// Stacks are not deployed while a dependency is not deployed or failed, unless overridden
+func TestBlockingDependency(t *testing.T) {
+	traefik := newSwarmStack("traefik", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	app := newSwarmStack("app", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	app.dependsOn = []*swarmStack{traefik}
+	stackStatus["traefik"] = &StackStatus{Status: StatusUnknown}
+	defer delete(stackStatus, "traefik")
+
+	if reason := app.blockingDeploy(context.Background(), TriggerPoll); reason != "dependency traefik is not deployed yet" {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+	// blocked by a sync window before its first deployment
+	stackStatus["traefik"] = &StackStatus{Status: StatusOutOfSync, Reason: "outside of sync windows"}
+	if reason := app.blockingDeploy(context.Background(), TriggerPoll); reason != "dependency traefik is not deployed yet" {
+		t.Errorf("unexpected reason of undeployed dependency: %s", reason)
+	}
+	stackStatus["traefik"] = &StackStatus{Status: StatusOutOfSync, Reason: "live services drifted from git", Revision: "abcdef12", composeHash: "hash"}
+	if reason := app.blockingDeploy(context.Background(), TriggerPoll); reason != "dependency traefik is out of sync: live services drifted from git" {
+		t.Errorf("unexpected reason of out of sync dependency: %s", reason)
+	}
+	stackStatus["traefik"].Status = StatusFailed
+	if reason := app.blockingDeploy(context.Background(), TriggerManual); reason != "dependency traefik failed to sync" {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+	if reason := app.blockingDeploy(context.Background(), TriggerOverride); reason != "" {
+		t.Errorf("unexpected reason of override: %s", reason)
+	}
+	if reason := traefik.blockingDeploy(context.Background(), TriggerPoll); reason != "" {
+		t.Errorf("unexpected reason of stack without dependencies: %s", reason)
+	}
+}
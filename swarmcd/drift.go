@@ -0,0 +1,183 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/cli/cli/compose/convert"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// DriftDiff is a difference between the desired state
+// of a service rendered from git and its live state
+type DriftDiff struct {
+	Service string
+	Field   string
+	Desired string
+	Live    string
+}
+
+// detectDrift compares the live services of the stack
+// to the services defined in the compose file
+func (swarmStack *swarmStack) detectDrift(ctx context.Context, composeBytes []byte, env map[string]string) ([]DriftDiff, error) {
+	composeConfig, err := swarmStack.loadComposeFile(composeBytes, env)
+	if err != nil {
+		return nil, err
+	}
+	client := dockerCli.Client()
+	namespace := convert.NewNamespace(swarmStack.name)
+	desiredServices, err := convert.Services(ctx, namespace, composeConfig, client)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert services of stack %s: %w", swarmStack.name, err)
+	}
+	liveServices, err := client.ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", convert.LabelNamespace+"="+swarmStack.name)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list services of stack %s: %w", swarmStack.name, err)
+	}
+	networks, err := client.NetworkList(ctx, network.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list networks: %w", err)
+	}
+	networkNames := map[string]string{}
+	for _, network := range networks {
+		networkNames[network.ID] = network.Name
+	}
+
+	liveSpecs := map[string]swarm.ServiceSpec{}
+	for _, service := range liveServices {
+		liveSpecs[service.Spec.Name] = service.Spec
+	}
+	serviceNames := make([]string, 0, len(desiredServices))
+	for serviceName := range desiredServices {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	var diffs []DriftDiff
+	for _, serviceName := range serviceNames {
+		scopedName := namespace.Scope(serviceName)
+		liveSpec, ok := liveSpecs[scopedName]
+		if !ok {
+			diffs = append(diffs, DriftDiff{Service: scopedName, Field: "service", Desired: "present", Live: "missing"})
+			continue
+		}
+		diffs = append(diffs, diffServiceSpecs(scopedName, desiredServices[serviceName], liveSpec, networkNames)...)
+	}
+	return diffs, nil
+}
+
+// diffServiceSpecs compares the fields of service specs that are
+// commonly changed by hand. Live network attachments refer to network
+// IDs, networkNames maps them back to the names used in compose files
+func diffServiceSpecs(serviceName string, desired swarm.ServiceSpec, live swarm.ServiceSpec, networkNames map[string]string) []DriftDiff {
+	var diffs []DriftDiff
+	compare := func(field string, desiredValue string, liveValue string) {
+		if desiredValue != liveValue {
+			diffs = append(diffs, DriftDiff{Service: serviceName, Field: field, Desired: desiredValue, Live: liveValue})
+		}
+	}
+	desiredContainer := desired.TaskTemplate.ContainerSpec
+	liveContainer := live.TaskTemplate.ContainerSpec
+	if desiredContainer == nil {
+		desiredContainer = &swarm.ContainerSpec{}
+	}
+	if liveContainer == nil {
+		liveContainer = &swarm.ContainerSpec{}
+	}
+
+	compare("image", normalizeImage(desiredContainer.Image), normalizeImage(liveContainer.Image))
+	compare("env", formatList(desiredContainer.Env), formatList(liveContainer.Env))
+	compare("replicas", formatReplicas(desired.Mode), formatReplicas(live.Mode))
+	compare("labels", formatMap(desired.Labels), formatMap(live.Labels))
+	compare("container_labels", formatMap(desiredContainer.Labels), formatMap(liveContainer.Labels))
+	compare("mounts", formatMounts(desiredContainer), formatMounts(liveContainer))
+	compare("networks", formatNetworks(desired.TaskTemplate.Networks, nil), formatNetworks(live.TaskTemplate.Networks, networkNames))
+	compare("resources", formatResources(desired.TaskTemplate.Resources), formatResources(live.TaskTemplate.Resources))
+	return diffs
+}
+
+func formatList(list []string) string {
+	sorted := slices.Clone(list)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func formatMap(values map[string]string) string {
+	var list []string
+	for key, value := range values {
+		list = append(list, key+"="+value)
+	}
+	return formatList(list)
+}
+
+// normalizeImage drops the digest swarm pins images to and adds the
+// default registry and tag, so that nginx matches docker.io/library/nginx:latest
+func normalizeImage(image string) string {
+	image, _ = splitImageDigest(image)
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
+
+func formatReplicas(mode swarm.ServiceMode) string {
+	switch {
+	case mode.Replicated != nil && mode.Replicated.Replicas != nil:
+		return fmt.Sprint(*mode.Replicated.Replicas)
+	// the daemon runs a single replica of services without replicas
+	case mode.Replicated != nil:
+		return "1"
+	case mode.Global != nil:
+		return "global"
+	default:
+		return ""
+	}
+}
+
+func formatMounts(containerSpec *swarm.ContainerSpec) string {
+	var list []string
+	for _, mount := range containerSpec.Mounts {
+		mountString := fmt.Sprintf("%s:%s:%s", mount.Type, mount.Source, mount.Target)
+		if mount.ReadOnly {
+			mountString += ":ro"
+		}
+		list = append(list, mountString)
+	}
+	return formatList(list)
+}
+
+func formatNetworks(networks []swarm.NetworkAttachmentConfig, networkNames map[string]string) string {
+	var list []string
+	for _, network := range networks {
+		name := network.Target
+		if networkName, ok := networkNames[name]; ok {
+			name = networkName
+		}
+		list = append(list, name)
+	}
+	return formatList(list)
+}
+
+func formatResources(resources *swarm.ResourceRequirements) string {
+	limits := &swarm.Limit{}
+	reservations := &swarm.Resources{}
+	if resources != nil && resources.Limits != nil {
+		limits = resources.Limits
+	}
+	if resources != nil && resources.Reservations != nil {
+		reservations = resources.Reservations
+	}
+	return fmt.Sprintf(
+		"limits: cpus=%d memory=%d pids=%d, reservations: cpus=%d memory=%d",
+		limits.NanoCPUs, limits.MemoryBytes, limits.Pids, reservations.NanoCPUs, reservations.MemoryBytes,
+	)
+}
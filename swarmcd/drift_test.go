@@ -0,0 +1,77 @@
+package swarmcd
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// Digests pinned by swarm and network IDs are not reported as drift
+func TestDiffServiceSpecsInSync(t *testing.T) {
+	replicas := uint64(2)
+	desired := swarm.ServiceSpec{
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.27", Env: []string{"A=1", "B=2"}},
+			Networks:      []swarm.NetworkAttachmentConfig{{Target: "test_default"}},
+		},
+	}
+	live := swarm.ServiceSpec{
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.27@sha256:abcdef", Env: []string{"B=2", "A=1"}},
+			Networks:      []swarm.NetworkAttachmentConfig{{Target: "n3tw0rk1d"}},
+			Resources:     &swarm.ResourceRequirements{},
+		},
+	}
+	diffs := diffServiceSpecs("test_nginx", desired, live, map[string]string{"n3tw0rk1d": "test_default"})
+	if len(diffs) != 0 {
+		t.Errorf("unexpected drift: %+v", diffs)
+	}
+}
+
+// Manual changes to live services are reported field by field
+func TestDiffServiceSpecsDrifted(t *testing.T) {
+	desiredReplicas, liveReplicas := uint64(2), uint64(5)
+	desired := swarm.ServiceSpec{
+		Mode:         swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &desiredReplicas}},
+		TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.27"}},
+	}
+	live := swarm.ServiceSpec{
+		Mode:         swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &liveReplicas}},
+		TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.26@sha256:abcdef"}},
+	}
+	diffs := diffServiceSpecs("test_nginx", desired, live, nil)
+	if len(diffs) != 2 {
+		t.Fatalf("unexpected number of differences: %+v", diffs)
+	}
+	if diffs[0].Field != "image" || diffs[0].Desired != "nginx:1.27" || diffs[0].Live != "nginx:1.26" {
+		t.Errorf("unexpected image difference: %+v", diffs[0])
+	}
+	if diffs[1].Field != "replicas" || diffs[1].Desired != "2" || diffs[1].Live != "5" {
+		t.Errorf("unexpected replicas difference: %+v", diffs[1])
+	}
+}
+
+// Defaults of compose files are not reported as drift
+func TestDiffServiceSpecsDefaults(t *testing.T) {
+	liveReplicas := uint64(1)
+	desired := swarm.ServiceSpec{
+		Mode:         swarm.ServiceMode{Replicated: &swarm.ReplicatedService{}},
+		TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx"}},
+	}
+	live := swarm.ServiceSpec{
+		Mode:         swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &liveReplicas}},
+		TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "docker.io/library/nginx:latest@sha256:abcdef"}},
+	}
+	diffs := diffServiceSpecs("test_nginx", desired, live, nil)
+	if len(diffs) != 0 {
+		t.Errorf("unexpected drift: %+v", diffs)
+	}
+
+	desired.TaskTemplate.ContainerSpec.Image = "registry.example.com/nginx"
+	diffs = diffServiceSpecs("test_nginx", desired, live, nil)
+	if len(diffs) != 1 || diffs[0].Desired != "registry.example.com/nginx:latest" || diffs[0].Live != "nginx:latest" {
+		t.Errorf("unexpected image difference: %+v", diffs)
+	}
+}
@@ -0,0 +1,127 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/docker/cli/cli/compose/loader"
+	"github.com/docker/cli/cli/compose/template"
+	composetypes "github.com/docker/cli/cli/compose/types"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// variablePattern is the pattern docker uses to find
+// the variables interpolated in compose files
+var variablePattern = regexp.MustCompile(
+	`\$(?i:(?P<escaped>\$)|(?P<named>[_a-z][_a-z0-9]*(?::?[-?][^}]*)?)|{(?P<braced>[_a-z][_a-z0-9]*(?::?[-?][^}]*)?)}|(?P<invalid>))`,
+)
+
+// readEnv returns the variables compose files of the stack are
+// interpolated with: the env files in order, then the env of the
+// stack config. Env files encrypted with sops are decrypted in memory,
+// within the decrypt timeout
+func (swarmStack *swarmStack) readEnv(ctx context.Context) (map[string]string, error) {
+	env := map[string]string{}
+	for _, envFile := range swarmStack.envFiles {
+		envBytes, err := os.ReadFile(path.Join(swarmStack.repo.path, envFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s stack env file: %w", swarmStack.name, err)
+		}
+		fileEnv, err := parseEnv(envFile, strings.Split(string(envBytes), "\n"))
+		if err != nil {
+			return nil, err
+		}
+		// sops adds its metadata to dotenv files as sops_ variables
+		if _, ok := fileEnv["sops_mac"]; ok {
+			decryptCtx, cancel := withStageTimeout(ctx, stageDecrypt)
+			envBytes, err = util.DecryptData(decryptCtx, envBytes, envFile)
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("could not decrypt %s stack env file: %w", swarmStack.name, err)
+			}
+			fileEnv, err = parseEnv(envFile, strings.Split(string(envBytes), "\n"))
+			if err != nil {
+				return nil, err
+			}
+		}
+		for key, value := range fileEnv {
+			env[key] = value
+		}
+	}
+	for key, value := range swarmStack.env {
+		env[key] = value
+	}
+	return env, nil
+}
+
+// parseEnv parses KEY=value lines, skipping empty lines and comments.
+// Quotes around values are removed, like docker does in env files
+func parseEnv(source string, lines []string) (map[string]string, error) {
+	env := map[string]string{}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid variable in %s at line %d, must be KEY=value", source, i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// loadCompose loads a compose file interpolating variables from env
+// only, not from the environment of SwarmCD. Variables that are not
+// set and have no default value are errors
+func loadCompose(configDict map[string]any, filename string, workingDir string, env map[string]string) (*composetypes.Config, error) {
+	return loader.Load(composetypes.ConfigDetails{
+		WorkingDir:  workingDir,
+		ConfigFiles: []composetypes.ConfigFile{{Filename: filename, Config: configDict}},
+		Environment: env,
+	}, func(options *loader.Options) {
+		options.Interpolate.Substitute = substituteVariables
+	})
+}
+
+func substituteVariables(value string, mapping template.Mapping) (string, error) {
+	return template.SubstituteWith(value, mapping, variablePattern, append([]template.SubstituteFunc{undefinedVariable}, template.DefaultSubstituteFuncs...)...)
+}
+
+// undefinedVariable fails the interpolation of unset variables.
+// Variables with a default value or marked as required are left
+// to the default substitutions
+func undefinedVariable(substitution string, mapping template.Mapping) (string, bool, error) {
+	if strings.ContainsAny(substitution, ":?-") {
+		return "", false, nil
+	}
+	if _, ok := mapping(substitution); !ok {
+		return "", false, fmt.Errorf("variable %s is not set", substitution)
+	}
+	return "", false, nil
+}
+
+// loadComposeFile loads the compose file of the stack from memory,
+// relative paths are resolved from the directory of the compose file
+func (swarmStack *swarmStack) loadComposeFile(composeBytes []byte, env map[string]string) (*composetypes.Config, error) {
+	composeFile := path.Join(swarmStack.repo.path, swarmStack.composePath)
+	configDict, err := loader.ParseYAML(composeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse compose file %s: %w", composeFile, err)
+	}
+	composeConfig, err := loadCompose(configDict, composeFile, path.Dir(composeFile), env)
+	if err != nil {
+		return nil, fmt.Errorf("could not load compose file of stack %s: %w", swarmStack.name, err)
+	}
+	return composeConfig, nil
+}
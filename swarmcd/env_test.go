@@ -0,0 +1,105 @@
+package swarmcd
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/docker/cli/cli/compose/loader"
+)
+
+// Env files are merged in order, the env of the stack config overrides them
+func TestReadEnv(t *testing.T) {
+	stack := newTemplateTestStack(t, map[string]string{
+		"base.env":    "# shared\nTAG=1.0\nDOMAIN=example.com\n\n",
+		"prod.env":    "export TAG=2.0\n",
+		"invalid.env": "DOMAIN\n",
+	})
+	stack.envFiles = []string{"base.env", "prod.env"}
+	stack.env = map[string]string{"DOMAIN": "prod.example.com"}
+	env, err := stack.readEnv(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(env) != 2 || env["TAG"] != "2.0" || env["DOMAIN"] != "prod.example.com" {
+		t.Errorf("unexpected env: %v", env)
+	}
+
+	stack.envFiles = []string{"invalid.env"}
+	_, err = stack.readEnv(context.Background())
+	if err == nil {
+		t.Errorf("expected an error for a variable without value")
+	}
+}
+
+// Quotes around values are not part of them
+func TestParseEnvQuotes(t *testing.T) {
+	env, err := parseEnv("test.env", []string{`A="quoted value"`, `B='single'`, `C="unmatched'`, `D=""`, `E = spaced `, `F="`})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]string{"A": "quoted value", "B": "single", "C": `"unmatched'`, "D": "", "E": "spaced", "F": `"`}
+	if !maps.Equal(env, expected) {
+		t.Errorf("unexpected env: %v", env)
+	}
+}
+
+// Compose files are interpolated from the env of the stack only
+func TestLoadComposeInterpolation(t *testing.T) {
+	t.Setenv("SWARMCD_TEST_TAG", "leaked")
+	configDict, err := loader.ParseYAML([]byte(`services:
+  app:
+    image: app:${TAG}
+    environment:
+      DOMAIN: ${DOMAIN:-example.com}
+      PRICE: $$5`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	composeConfig, err := loadCompose(configDict, "docker-compose.yaml", t.TempDir(), map[string]string{"TAG": "1.0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	service := composeConfig.Services[0]
+	if service.Image != "app:1.0" || *service.Environment["DOMAIN"] != "example.com" || *service.Environment["PRICE"] != "$5" {
+		t.Errorf("unexpected service: %s %v", service.Image, service.Environment)
+	}
+
+	configDict, _ = loader.ParseYAML([]byte(`services:
+  app:
+    image: app:${SWARMCD_TEST_TAG}`))
+	_, err = loadCompose(configDict, "docker-compose.yaml", t.TempDir(), map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "variable SWARMCD_TEST_TAG is not set") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Compose files are loaded from memory, with the paths of
+// configs relative to the compose file in the worktree
+func TestLoadComposeFileFromMemory(t *testing.T) {
+	stack := newTemplateTestStack(t, nil)
+	stack.composePath = "stacks/docker-compose.yaml"
+	composeConfig, err := stack.loadComposeFile([]byte(`services:
+  app:
+    image: app:${TAG}
+configs:
+  app:
+    file: app.conf
+`), map[string]string{"TAG": "1.0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if composeConfig.Services[0].Image != "app:1.0" {
+		t.Errorf("unexpected image: %s", composeConfig.Services[0].Image)
+	}
+	if composeConfig.Configs["app"].File != path.Join(stack.repo.path, "stacks/app.conf") {
+		t.Errorf("unexpected config file: %s", composeConfig.Configs["app"].File)
+	}
+	_, err = os.Stat(path.Join(stack.repo.path, stack.composePath))
+	if !os.IsNotExist(err) {
+		t.Errorf("compose file was written to disk: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package swarmcd
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventStatus       EventType = "status"
+	EventSyncStarted  EventType = "sync_started"
+	EventSyncFinished EventType = "sync_finished"
+	EventDeployError  EventType = "deploy_error"
+	EventRecovered    EventType = "recovered"
+	EventRollout      EventType = "rollout"
+	EventRollback     EventType = "rollback"
+)
+
+type Event struct {
+	ID       uint64
+	Type     EventType
+	Stack    string
+	Revision string
+	Message  string
+	Time     time.Time
+}
+
+// subscribers that can't keep up are dropped
+// and expected to reconnect and replay what they missed
+const subscriberBufferSize = 64
+
+type eventBroker struct {
+	lock        *sync.Mutex
+	lastID      uint64
+	buffer      []Event
+	bufferSize  int
+	subscribers map[chan Event]struct{}
+}
+
+var events *eventBroker
+
+func newEventBroker(bufferSize int) *eventBroker {
+	return &eventBroker{
+		lock:        &sync.Mutex{},
+		bufferSize:  bufferSize,
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+func (broker *eventBroker) publish(event Event) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	broker.lastID++
+	event.ID = broker.lastID
+	event.Time = time.Now()
+	broker.buffer = append(broker.buffer, event)
+	if len(broker.buffer) > broker.bufferSize {
+		broker.buffer = broker.buffer[len(broker.buffer)-broker.bufferSize:]
+	}
+	for subscriber := range broker.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			logger.Warn("dropping slow events subscriber")
+			delete(broker.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// subscribe returns a channel of new events and the buffered
+// events published after lastEventID. A lastEventID of 0 skips the replay
+func (broker *eventBroker) subscribe(lastEventID uint64) (chan Event, []Event) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	var replay []Event
+	if lastEventID != 0 {
+		for _, event := range broker.buffer {
+			if event.ID > lastEventID {
+				replay = append(replay, event)
+			}
+		}
+	}
+	subscriber := make(chan Event, subscriberBufferSize)
+	broker.subscribers[subscriber] = struct{}{}
+	return subscriber, replay
+}
+
+func (broker *eventBroker) unsubscribe(subscriber chan Event) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if _, ok := broker.subscribers[subscriber]; ok {
+		delete(broker.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+func publishEvent(eventType EventType, stack string, revision string, message string) {
+	events.publish(Event{
+		Type:     eventType,
+		Stack:    stack,
+		Revision: revision,
+		Message:  message,
+	})
+}
+
+func SubscribeEvents(lastEventID uint64) (chan Event, []Event) {
+	return events.subscribe(lastEventID)
+}
+
+func UnsubscribeEvents(subscriber chan Event) {
+	events.unsubscribe(subscriber)
+}
@@ -0,0 +1,40 @@
+package swarmcd
+
+import (
+	"testing"
+)
+
+// Reconnecting subscribers only replay buffered events newer than their last event
+func TestEventsReplay(t *testing.T) {
+	broker := newEventBroker(2)
+	for i := 0; i < 3; i++ {
+		broker.publish(Event{Type: EventSyncStarted, Stack: "test"})
+	}
+	subscriber, replay := broker.subscribe(1)
+	defer broker.unsubscribe(subscriber)
+	if len(replay) != 2 {
+		t.Fatalf("unexpected number of replayed events: %d", len(replay))
+	}
+	if replay[0].ID != 2 || replay[1].ID != 3 {
+		t.Errorf("unexpected replayed events: %d, %d", replay[0].ID, replay[1].ID)
+	}
+	_, replay = broker.subscribe(0)
+	if len(replay) != 0 {
+		t.Errorf("new subscribers should not replay events, got %d", len(replay))
+	}
+}
+
+// New events are delivered to subscribers
+func TestEventsSubscribe(t *testing.T) {
+	broker := newEventBroker(10)
+	subscriber, _ := broker.subscribe(0)
+	broker.publish(Event{Type: EventRollout, Stack: "test", Revision: "abcdef12"})
+	event := <-subscriber
+	if event.Type != EventRollout || event.Revision != "abcdef12" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	broker.unsubscribe(subscriber)
+	if _, ok := <-subscriber; ok {
+		t.Errorf("subscriber channel should be closed after unsubscribing")
+	}
+}
@@ -0,0 +1,89 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck is the result of a single liveness or readiness check
+type HealthCheck struct {
+	Name    string
+	Healthy bool
+	Error   string
+}
+
+// heartbeat is the unix time in nanoseconds of the last iteration
+// of the reconcile loop with a free worker or of the last finished update
+var heartbeat atomic.Int64
+
+func beat() {
+	heartbeat.Store(time.Now().UnixNano())
+}
+
+func heartbeatTimeout() time.Duration {
+	if config.HeartbeatTimeout > 0 {
+		return time.Duration(config.HeartbeatTimeout) * time.Second
+	}
+	return 3 * time.Duration(config.UpdateInterval) * time.Second
+}
+
+// CheckLiveness checks that the reconcile loop is still running
+func CheckLiveness() ([]HealthCheck, bool) {
+	check := HealthCheck{Name: "heartbeat", Healthy: true}
+	lastBeat := heartbeat.Load()
+	if lastBeat == 0 {
+		check.Healthy = false
+		check.Error = "reconcile loop has not started"
+	} else if elapsed := time.Since(time.Unix(0, lastBeat)); elapsed > heartbeatTimeout() {
+		check.Healthy = false
+		check.Error = fmt.Sprintf("last reconcile loop heartbeat was %s ago", elapsed.Round(time.Second))
+	}
+	return []HealthCheck{check}, check.Healthy
+}
+
+// CheckReadiness checks that the docker daemon is reachable and that
+// every repo with stacks has been cloned or pulled successfully. The
+// server only starts once the configuration is loaded
+func CheckReadiness(ctx context.Context) ([]HealthCheck, bool) {
+	var checks []HealthCheck
+	dockerCheck := HealthCheck{Name: "docker", Healthy: true}
+	if dockerCli == nil {
+		dockerCheck.Healthy = false
+		dockerCheck.Error = "docker client is not initialized"
+	} else {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err := dockerCli.Client().Ping(pingCtx)
+		if err != nil {
+			dockerCheck.Healthy = false
+			dockerCheck.Error = fmt.Sprintf("could not reach docker daemon: %s", err)
+		}
+	}
+	checks = append(checks, dockerCheck)
+
+	stackRepos := map[string]*stackRepo{}
+	for _, swarmStack := range stacks {
+		stackRepos[swarmStack.repo.name] = swarmStack.repo
+	}
+	var repoNames []string
+	for repoName := range stackRepos {
+		repoNames = append(repoNames, repoName)
+	}
+	sort.Strings(repoNames)
+	for _, repoName := range repoNames {
+		repoCheck := HealthCheck{Name: "repo " + repoName, Healthy: stackRepos[repoName].synced.Load()}
+		if !repoCheck.Healthy {
+			repoCheck.Error = fmt.Sprintf("repo %s has not been cloned or pulled yet", repoName)
+		}
+		checks = append(checks, repoCheck)
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.Healthy
+	}
+	return checks, ready
+}
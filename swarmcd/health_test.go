@@ -0,0 +1,87 @@
+package swarmcd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The reconcile loop is unhealthy until it starts and when its heartbeat is stale
+func TestLivenessHeartbeat(t *testing.T) {
+	previousTimeout := config.HeartbeatTimeout
+	config.HeartbeatTimeout = 60
+	defer func() {
+		config.HeartbeatTimeout = previousTimeout
+		heartbeat.Store(0)
+	}()
+
+	heartbeat.Store(0)
+	if _, healthy := CheckLiveness(); healthy {
+		t.Errorf("unexpected healthy status before the loop started")
+	}
+	beat()
+	if _, healthy := CheckLiveness(); !healthy {
+		t.Errorf("unexpected unhealthy status after a heartbeat")
+	}
+	heartbeat.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	checks, healthy := CheckLiveness()
+	if healthy || checks[0].Error == "" {
+		t.Errorf("unexpected status with a stale heartbeat: %+v", checks)
+	}
+}
+
+// The reconcile loop does not beat while all workers are busy
+func TestBeatWhileWorkerFree(t *testing.T) {
+	defer heartbeat.Store(0)
+	busy := newSwarmStack("busy", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	scheduler.lock.Lock()
+	scheduler.workers = 1
+	scheduler.running[busy] = true
+	scheduler.lock.Unlock()
+	defer func() {
+		scheduler.lock.Lock()
+		scheduler.workers = 0
+		delete(scheduler.running, busy)
+		scheduler.lock.Unlock()
+	}()
+
+	heartbeat.Store(0)
+	beatWhileWorkerFree()
+	if heartbeat.Load() != 0 {
+		t.Errorf("unexpected heartbeat while all workers are busy")
+	}
+	scheduler.lock.Lock()
+	delete(scheduler.running, busy)
+	scheduler.lock.Unlock()
+	beatWhileWorkerFree()
+	if heartbeat.Load() == 0 {
+		t.Errorf("missing heartbeat while a worker is free")
+	}
+}
+
+// Repos are not ready until they were cloned or pulled successfully
+func TestCheckReadinessRepos(t *testing.T) {
+	repo := &stackRepo{name: "readiness-test", lock: &sync.Mutex{}}
+	stack := newSwarmStack("readiness-test", repo, "main", "docker-compose.yaml", nil, "", false, false)
+	stacks = append(stacks, stack)
+	defer func() { stacks = stacks[:len(stacks)-1] }()
+
+	repoCheck := func() HealthCheck {
+		checks, _ := CheckReadiness(context.Background())
+		for _, check := range checks {
+			if check.Name == "repo readiness-test" {
+				return check
+			}
+		}
+		t.Fatalf("no check of the repo: %+v", checks)
+		return HealthCheck{}
+	}
+	if check := repoCheck(); check.Healthy || check.Error != "repo readiness-test has not been cloned or pulled yet" {
+		t.Errorf("unexpected check of a repo that was not pulled: %+v", check)
+	}
+	repo.synced.Store(true)
+	if check := repoCheck(); !check.Healthy {
+		t.Errorf("unexpected check of a pulled repo: %+v", check)
+	}
+}
@@ -0,0 +1,300 @@
+package swarmcd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type Trigger string
+
+const (
+	TriggerPoll     Trigger = "poll"
+	TriggerWebhook  Trigger = "webhook"
+	TriggerManual   Trigger = "manual"
+	TriggerRollback Trigger = "rollback"
+	// a manual sync ignoring sync windows
+	TriggerOverride Trigger = "override"
+)
+
+const (
+	OutcomeSuccess   = "success"
+	OutcomeFailure   = "failure"
+	OutcomeOutOfSync = "out_of_sync"
+)
+
+type HistoryEntry struct {
+	ID            uint64
+	SyncID        string
+	Revision      string
+	CommitMessage string
+	Trigger       Trigger
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Outcome       string
+	FailedStage   string
+	Error         string
+	ComposeHash   string
+}
+
+var (
+	historyBucket  = []byte("history")
+	composesBucket = []byte("composes")
+	pausedBucket   = []byte("paused")
+)
+
+type historyStore struct {
+	db    *bolt.DB
+	limit int
+}
+
+var history *historyStore
+
+func openHistoryStore(statePath string, limit int) (*historyStore, error) {
+	err := os.MkdirAll(statePath, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create state directory %s: %w", statePath, err)
+	}
+	dbFile := path.Join(statePath, "swarm-cd.db")
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open state database %s: %w", dbFile, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{historyBucket, composesBucket, pausedBucket} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize state database %s: %w", dbFile, err)
+	}
+	return &historyStore{db: db, limit: limit}, nil
+}
+
+func closeHistory() {
+	if history == nil {
+		return
+	}
+	err := history.db.Close()
+	if err != nil {
+		logger.Error(fmt.Sprintf("could not close state database: %s", err))
+	}
+}
+
+// add stores the entry in the stack history along with the deployed
+// compose file, dropping the oldest entries and the compose files only
+// they reference when the history limit is exceeded
+func (store *historyStore) add(stackName string, entry *HistoryEntry, composeBytes []byte) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(stackName))
+		if err != nil {
+			return err
+		}
+		composes, err := tx.Bucket(composesBucket).CreateBucketIfNotExists([]byte(stackName))
+		if err != nil {
+			return err
+		}
+		entry.ID, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		entryBytes, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(historyKey(entry.ID), entryBytes)
+		if err != nil {
+			return err
+		}
+		if composeBytes != nil && entry.ComposeHash != "" {
+			err = composes.Put([]byte(entry.ComposeHash), composeBytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, key...))
+		}
+		if len(keys) <= store.limit {
+			return nil
+		}
+		prunedHashes := map[string]bool{}
+		for _, key := range keys[:len(keys)-store.limit] {
+			var prunedEntry HistoryEntry
+			err = json.Unmarshal(bucket.Get(key), &prunedEntry)
+			if err != nil {
+				return err
+			}
+			prunedHashes[prunedEntry.ComposeHash] = true
+			err = bucket.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		err = bucket.ForEach(func(_, value []byte) error {
+			var entry HistoryEntry
+			err := json.Unmarshal(value, &entry)
+			delete(prunedHashes, entry.ComposeHash)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for hash := range prunedHashes {
+			err = composes.Delete([]byte(hash))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// minRevisionLength is the length of the shortest
+// revision that can be looked up in the history
+const minRevisionLength = 7
+
+// findCompose returns the latest successful deployment of a
+// revision, given as a short or full hash, and its compose file
+func (store *historyStore) findCompose(stackName string, revision string) (*HistoryEntry, []byte, error) {
+	if len(revision) < minRevisionLength {
+		return nil, nil, fmt.Errorf("revision %s is too short, give at least %d characters", revision, minRevisionLength)
+	}
+	entries, err := store.list(stackName, store.limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var found *HistoryEntry
+	var foundCompose []byte
+	matchedRevision := ""
+	for _, entry := range entries {
+		if entry.Outcome != OutcomeSuccess || entry.Revision == "" {
+			continue
+		}
+		if !strings.HasPrefix(revision, entry.Revision) && !strings.HasPrefix(entry.Revision, revision) {
+			continue
+		}
+		if matchedRevision != "" && entry.Revision != matchedRevision {
+			return nil, nil, fmt.Errorf("revision %s of stack %s is ambiguous, it matches %s and %s", revision, stackName, matchedRevision, entry.Revision)
+		}
+		matchedRevision = entry.Revision
+		if found != nil {
+			continue
+		}
+		var composeBytes []byte
+		err = store.db.View(func(tx *bolt.Tx) error {
+			composes := tx.Bucket(composesBucket).Bucket([]byte(stackName))
+			if composes != nil {
+				composeBytes = append([]byte{}, composes.Get([]byte(entry.ComposeHash))...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(composeBytes) != 0 {
+			found = &entry
+			foundCompose = composeBytes
+		}
+	}
+	if found == nil {
+		return nil, nil, fmt.Errorf("no stored compose file for revision %s of stack %s", revision, stackName)
+	}
+	return found, foundCompose, nil
+}
+
+func (store *historyStore) setAutoSyncPaused(stackName string, paused bool) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if paused {
+			return tx.Bucket(pausedBucket).Put([]byte(stackName), []byte{1})
+		}
+		return tx.Bucket(pausedBucket).Delete([]byte(stackName))
+	})
+}
+
+func (store *historyStore) isAutoSyncPaused(stackName string) (paused bool) {
+	store.db.View(func(tx *bolt.Tx) error {
+		paused = tx.Bucket(pausedBucket).Get([]byte(stackName)) != nil
+		return nil
+	})
+	return
+}
+
+// list returns the most recent entries of the stack history, newest first
+func (store *historyStore) list(stackName string, limit int) ([]HistoryEntry, error) {
+	entries := []HistoryEntry{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(stackName))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.Last(); key != nil && len(entries) < limit; key, value = cursor.Prev() {
+			var entry HistoryEntry
+			err := json.Unmarshal(value, &entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read history of stack %s: %w", stackName, err)
+	}
+	return entries, nil
+}
+
+func historyKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func GetStackHistory(stackName string, limit int) ([]HistoryEntry, error) {
+	if getSwarmStack(stackName) == nil {
+		return nil, ErrStackNotFound
+	}
+	return history.list(stackName, limit)
+}
+
+// restoreStackStatus sets the stack status from the
+// last recorded sync so it survives restarts
+func restoreStackStatus(stackName string) error {
+	status := stackStatus[stackName]
+	status.AutoSyncPaused = history.isAutoSyncPaused(stackName)
+	entries, err := history.list(stackName, history.limit)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	switch entries[0].Outcome {
+	case OutcomeSuccess:
+		status.Status = StatusSynced
+	case OutcomeOutOfSync:
+		status.Status = StatusOutOfSync
+	default:
+		status.Status = StatusFailed
+		status.Error = entries[0].Error
+	}
+	for _, entry := range entries {
+		if entry.Outcome == OutcomeSuccess {
+			status.Revision = entry.Revision
+			status.composeHash = entry.ComposeHash
+			break
+		}
+	}
+	return nil
+}
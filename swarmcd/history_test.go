@@ -0,0 +1,89 @@
+package swarmcd
+
+import (
+	"testing"
+)
+
+// History is listed newest first and trimmed to the history limit
+func TestHistoryLimit(t *testing.T) {
+	store, err := openHistoryStore(t.TempDir(), 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer store.db.Close()
+	for _, revision := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc"} {
+		err = store.add("test", &HistoryEntry{Revision: revision, Trigger: TriggerPoll, Outcome: OutcomeSuccess}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	entries, err := store.list("test", 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of history entries: %d", len(entries))
+	}
+	if entries[0].Revision != "cccccccc" || entries[1].Revision != "bbbbbbbb" {
+		t.Errorf("unexpected history entries: %s, %s", entries[0].Revision, entries[1].Revision)
+	}
+	entries, err = store.list("other", 10)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("unexpected history of unknown stack: %v, %v", entries, err)
+	}
+}
+
+// Compose files are found by short or full revision and pruned with their history entries
+func TestHistoryFindCompose(t *testing.T) {
+	store, err := openHistoryStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer store.db.Close()
+	err = store.add("test", &HistoryEntry{Revision: "aaaaaaaa", Outcome: OutcomeSuccess, ComposeHash: "hash-a"}, []byte("compose-a"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entry, composeBytes, err := store.findCompose("test", "aaaaaaaa0123456789")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if entry.Revision != "aaaaaaaa" || string(composeBytes) != "compose-a" {
+		t.Errorf("unexpected compose for revision: %s, %s", entry.Revision, composeBytes)
+	}
+	err = store.add("test", &HistoryEntry{Revision: "bbbbbbbb", Outcome: OutcomeSuccess, ComposeHash: "hash-b"}, []byte("compose-b"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, _, err = store.findCompose("test", "aaaaaaaa")
+	if err == nil {
+		t.Errorf("expected compose of pruned revision to be removed")
+	}
+}
+
+func TestHistoryFindComposeAmbiguous(t *testing.T) {
+	store, err := openHistoryStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer store.db.Close()
+	for _, revision := range []string{"abcdef01", "abcdef02"} {
+		err = store.add("test", &HistoryEntry{Revision: revision, Outcome: OutcomeSuccess, ComposeHash: "hash-" + revision}, []byte("compose-"+revision))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for _, revision := range []string{"a", "abcdef", "abcdef0"} {
+		_, _, err = store.findCompose("test", revision)
+		if err == nil {
+			t.Errorf("expected revision %s to be rejected", revision)
+		}
+	}
+	entry, composeBytes, err := store.findCompose("test", "abcdef02")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if entry.Revision != "abcdef02" || string(composeBytes) != "compose-abcdef02" {
+		t.Errorf("unexpected compose for revision: %s, %s", entry.Revision, composeBytes)
+	}
+}
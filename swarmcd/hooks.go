@@ -0,0 +1,457 @@
+package swarmcd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/compose/convert"
+	"github.com/docker/cli/cli/compose/loader"
+	composetypes "github.com/docker/cli/cli/compose/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/goccy/go-yaml"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// hookLabel marks compose services that are hooks
+// instead of services of the stack
+const hookLabel = "swarmcd.hook"
+
+// hooks run in the update stage of the same name
+const (
+	hookPreSync  = stagePreSync
+	hookPostSync = stagePostSync
+)
+
+const (
+	HookSucceeded = "succeeded"
+	HookFailed    = "failed"
+)
+
+// how often hook jobs are checked for completion
+var hookPollInterval = 2 * time.Second
+
+// how many lines of the output of a hook job are kept
+const hookLogsTail = "100"
+
+// stackHook is a one-shot job run before or after the stack is
+// deployed, e.g. to migrate a database or to run smoke tests
+type stackHook struct {
+	name string
+	hook string
+	// the compose service definition of the job
+	service map[string]any
+}
+
+// HookResult is the outcome of a hook job
+type HookResult struct {
+	Name       string
+	Hook       string
+	Status     string
+	Error      string
+	Logs       string
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+func isHook(hook string) bool {
+	return hook == hookPreSync || hook == hookPostSync
+}
+
+// newConfigHooks converts the hooks of a stack config
+// into compose service definitions
+func newConfigHooks(stackName string, hookConfigs []*util.HookConfig) ([]*stackHook, error) {
+	var hooks []*stackHook
+	for i, hookConfig := range hookConfigs {
+		if hookConfig.Name == "" {
+			return nil, fmt.Errorf("hook #%d of %s stack has no name", i+1, stackName)
+		}
+		if !isHook(hookConfig.Hook) {
+			return nil, fmt.Errorf("invalid hook %s of %s hook of %s stack, must be one of %s or %s", hookConfig.Hook, hookConfig.Name, stackName, hookPreSync, hookPostSync)
+		}
+		if hookConfig.Image == "" {
+			return nil, fmt.Errorf("%s hook of %s stack has no image", hookConfig.Name, stackName)
+		}
+		service := map[string]any{
+			"image":  hookConfig.Image,
+			"labels": map[string]any{hookLabel: hookConfig.Hook},
+		}
+		if len(hookConfig.Command) != 0 {
+			service["command"] = hookConfig.Command
+		}
+		if len(hookConfig.Environment) != 0 {
+			service["environment"] = hookConfig.Environment
+		}
+		if len(hookConfig.Networks) != 0 {
+			service["networks"] = hookConfig.Networks
+		}
+		hooks = append(hooks, &stackHook{name: hookConfig.Name, hook: hookConfig.Hook, service: service})
+	}
+	return hooks, nil
+}
+
+// extractHooks removes the services labeled as hooks from
+// the compose file, so that they are not deployed with the stack
+func extractHooks(composeMap map[string]any) ([]*stackHook, error) {
+	services, ok := composeMap["services"].(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	var serviceNames []string
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	var hooks []*stackHook
+	for _, serviceName := range serviceNames {
+		service, ok := services[serviceName].(map[string]any)
+		if !ok {
+			continue
+		}
+		hook := serviceLabel(service, hookLabel)
+		if hook == "" {
+			continue
+		}
+		if !isHook(hook) {
+			return nil, fmt.Errorf("invalid %s label %s of %s service, must be one of %s or %s", hookLabel, hook, serviceName, hookPreSync, hookPostSync)
+		}
+		delete(services, serviceName)
+		hooks = append(hooks, &stackHook{name: serviceName, hook: hook, service: service})
+	}
+	return hooks, nil
+}
+
+// serviceLabel returns a label of the service or of its deployment,
+// labels are either a map or a list of key=value strings
+func serviceLabel(service map[string]any, key string) string {
+	labelSets := []any{service["labels"]}
+	if deploy, ok := service["deploy"].(map[string]any); ok {
+		labelSets = append(labelSets, deploy["labels"])
+	}
+	for _, labels := range labelSets {
+		switch labels := labels.(type) {
+		case map[string]any:
+			if value, ok := labels[key]; ok {
+				return fmt.Sprint(value)
+			}
+		case []any:
+			for _, label := range labels {
+				labelKey, value, _ := strings.Cut(fmt.Sprint(label), "=")
+				if labelKey == key {
+					return value
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// runHooks runs the hooks of a kind one after another
+// and stops at the first one that fails
+func (swarmStack *swarmStack) runHooks(ctx context.Context, hooks []*stackHook, kind string, composeMap map[string]any, result *syncResult, log *slog.Logger) error {
+	for _, hook := range hooks {
+		if hook.hook != kind {
+			continue
+		}
+		log := log.With(slog.String("hook", hook.name))
+		log.Info("running hook...")
+		hookResult := HookResult{Name: hook.name, Hook: kind, Status: HookSucceeded, StartedAt: time.Now()}
+		logs, err := swarmStack.runHook(ctx, hook, composeMap, result.env, log)
+		hookResult.FinishedAt = time.Now()
+		hookResult.Logs = logs
+		if err != nil {
+			hookResult.Status = HookFailed
+			hookResult.Error = err.Error()
+		}
+		result.hooks = append(result.hooks, hookResult)
+		if err != nil {
+			return fmt.Errorf("%s hook %s of stack %s failed: %w", kind, hook.name, swarmStack.name, err)
+		}
+		log.Info("hook succeeded")
+	}
+	return nil
+}
+
+// runHook runs a hook as a replicated job service, waits for
+// it to complete and removes it. Returns the output of the job
+func (swarmStack *swarmStack) runHook(ctx context.Context, hook *stackHook, composeMap map[string]any, env map[string]string, log *slog.Logger) (string, error) {
+	apiClient := dockerCli.Client()
+	workingDir := path.Dir(path.Join(swarmStack.repo.path, swarmStack.composePath))
+	composeConfig, err := loadHookCompose(hook, composeMap, workingDir, env)
+	if err != nil {
+		return "", err
+	}
+	namespace := convert.NewNamespace(swarmStack.name)
+	err = createHookNetworks(ctx, apiClient, namespace, composeConfig)
+	if err != nil {
+		return "", err
+	}
+	err = createHookObjects(ctx, apiClient, namespace, composeConfig)
+	if err != nil {
+		return "", err
+	}
+	spec, err := hookServiceSpec(ctx, apiClient, namespace, composeConfig, hook.name)
+	if err != nil {
+		return "", err
+	}
+
+	// a hook service left over by an interrupted sync is replaced
+	err = removeService(ctx, apiClient, spec.Name)
+	if err != nil {
+		return "", err
+	}
+	auth, err := command.RetrieveAuthTokenFromImage(dockerCli.ConfigFile(), spec.TaskTemplate.ContainerSpec.Image)
+	if err != nil {
+		return "", fmt.Errorf("could not get registry credentials of hook image: %w", err)
+	}
+	response, err := apiClient.ServiceCreate(ctx, spec, types.ServiceCreateOptions{EncodedRegistryAuth: auth, QueryRegistry: true})
+	if err != nil {
+		return "", fmt.Errorf("could not create hook service %s: %w", spec.Name, err)
+	}
+	// the hook is removed even if the sync is cancelled
+	defer func() {
+		err := apiClient.ServiceRemove(context.WithoutCancel(ctx), response.ID)
+		if err != nil {
+			log.Warn("could not remove hook service", "service", spec.Name, "error", err.Error())
+		}
+	}()
+
+	waitErr := waitForHook(ctx, apiClient, response.ID, stageTimeout(hook.hook))
+	logs, err := hookLogs(context.WithoutCancel(ctx), apiClient, response.ID)
+	if err != nil {
+		log.Warn("could not read hook logs", "error", err.Error())
+	}
+	return logs, waitErr
+}
+
+// loadHookCompose loads the hook service along with the networks,
+// volumes, configs and secrets of the stack it may refer to
+func loadHookCompose(hook *stackHook, composeMap map[string]any, workingDir string, env map[string]string) (*composetypes.Config, error) {
+	hookCompose := map[string]any{"services": map[string]any{hook.name: hook.service}}
+	for _, key := range []string{"version", "networks", "volumes", "configs", "secrets"} {
+		if value, ok := composeMap[key]; ok {
+			hookCompose[key] = value
+		}
+	}
+	composeBytes, err := yaml.Marshal(hookCompose)
+	if err != nil {
+		return nil, fmt.Errorf("could not write compose file of %s hook: %w", hook.name, err)
+	}
+	configDict, err := loader.ParseYAML(composeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse compose file of %s hook: %w", hook.name, err)
+	}
+	composeConfig, err := loadCompose(configDict, hook.name, workingDir, env)
+	if err != nil {
+		return nil, fmt.Errorf("could not load compose file of %s hook: %w", hook.name, err)
+	}
+	return composeConfig, nil
+}
+
+// hookServiceSpec converts the hook service into a job
+// that runs a single task once and is never restarted
+func hookServiceSpec(ctx context.Context, apiClient client.CommonAPIClient, namespace convert.Namespace, composeConfig *composetypes.Config, hookName string) (swarm.ServiceSpec, error) {
+	services, err := convert.Services(ctx, namespace, composeConfig, apiClient)
+	if err != nil {
+		return swarm.ServiceSpec{}, fmt.Errorf("could not convert service of %s hook: %w", hookName, err)
+	}
+	spec := services[hookName]
+	completions := uint64(1)
+	spec.Mode = swarm.ServiceMode{ReplicatedJob: &swarm.ReplicatedJob{
+		MaxConcurrent:    &completions,
+		TotalCompletions: &completions,
+	}}
+	spec.TaskTemplate.RestartPolicy = &swarm.RestartPolicy{Condition: swarm.RestartPolicyConditionNone}
+	// jobs do not support rolling updates
+	spec.UpdateConfig = nil
+	spec.RollbackConfig = nil
+	return spec, nil
+}
+
+// createHookNetworks creates the stack networks used by the hook that
+// do not exist yet. They are created by the first deployment of the
+// stack otherwise, after pre-sync hooks have run
+func createHookNetworks(ctx context.Context, apiClient client.APIClient, namespace convert.Namespace, composeConfig *composetypes.Config) error {
+	serviceNetworks := map[string]struct{}{}
+	for _, service := range composeConfig.Services {
+		if len(service.Networks) == 0 {
+			serviceNetworks["default"] = struct{}{}
+		}
+		for networkName := range service.Networks {
+			serviceNetworks[networkName] = struct{}{}
+		}
+	}
+	networks, _ := convert.Networks(namespace, composeConfig.Networks, serviceNetworks)
+	existingNetworks, err := apiClient.NetworkList(ctx, network.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", convert.LabelNamespace+"="+namespace.Name())),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list networks of stack %s: %w", namespace.Name(), err)
+	}
+	for networkName, createOptions := range networks {
+		if slices.ContainsFunc(existingNetworks, func(existing network.Summary) bool { return existing.Name == networkName }) {
+			continue
+		}
+		if createOptions.Driver == "" {
+			createOptions.Driver = "overlay"
+		}
+		_, err = apiClient.NetworkCreate(ctx, networkName, createOptions)
+		if err != nil {
+			return fmt.Errorf("could not create network %s: %w", networkName, err)
+		}
+	}
+	return nil
+}
+
+// createHookObjects creates the stack configs and secrets used by the
+// hook that do not exist yet, like docker stack deploy does. They are
+// missing before the first deployment of the stack, and after auto
+// rotation renamed them, until the stack is deployed
+func createHookObjects(ctx context.Context, apiClient client.APIClient, namespace convert.Namespace, composeConfig *composetypes.Config) error {
+	secrets := map[string]composetypes.SecretConfig{}
+	configs := map[string]composetypes.ConfigObjConfig{}
+	for _, service := range composeConfig.Services {
+		for _, secret := range service.Secrets {
+			if secretConfig, ok := composeConfig.Secrets[secret.Source]; ok {
+				secrets[secret.Source] = secretConfig
+			}
+		}
+		for _, config := range service.Configs {
+			if configConfig, ok := composeConfig.Configs[config.Source]; ok {
+				configs[config.Source] = configConfig
+			}
+		}
+	}
+	secretSpecs, err := convert.Secrets(namespace, secrets)
+	if err != nil {
+		return fmt.Errorf("could not convert secrets of stack %s: %w", namespace.Name(), err)
+	}
+	for _, secretSpec := range secretSpecs {
+		_, _, err = apiClient.SecretInspectWithRaw(ctx, secretSpec.Name)
+		if err == nil {
+			continue
+		}
+		if !errdefs.IsNotFound(err) {
+			return fmt.Errorf("could not inspect secret %s: %w", secretSpec.Name, err)
+		}
+		_, err = apiClient.SecretCreate(ctx, secretSpec)
+		if err != nil {
+			return fmt.Errorf("could not create secret %s: %w", secretSpec.Name, err)
+		}
+	}
+	configSpecs, err := convert.Configs(namespace, configs)
+	if err != nil {
+		return fmt.Errorf("could not convert configs of stack %s: %w", namespace.Name(), err)
+	}
+	for _, configSpec := range configSpecs {
+		_, _, err = apiClient.ConfigInspectWithRaw(ctx, configSpec.Name)
+		if err == nil {
+			continue
+		}
+		if !errdefs.IsNotFound(err) {
+			return fmt.Errorf("could not inspect config %s: %w", configSpec.Name, err)
+		}
+		_, err = apiClient.ConfigCreate(ctx, configSpec)
+		if err != nil {
+			return fmt.Errorf("could not create config %s: %w", configSpec.Name, err)
+		}
+	}
+	return nil
+}
+
+func removeService(ctx context.Context, apiClient client.APIClient, serviceName string) error {
+	services, err := apiClient.ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("name", serviceName)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list services: %w", err)
+	}
+	for _, service := range services {
+		// the name filter matches prefixes
+		if service.Spec.Name != serviceName {
+			continue
+		}
+		err = apiClient.ServiceRemove(ctx, service.ID)
+		if err != nil {
+			return fmt.Errorf("could not remove service %s: %w", serviceName, err)
+		}
+	}
+	return nil
+}
+
+// waitForHook waits until the task of the hook job has completed or failed
+func waitForHook(ctx context.Context, apiClient client.APIClient, serviceID string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(hookPollInterval)
+	defer ticker.Stop()
+	for {
+		tasks, err := apiClient.TaskList(ctx, types.TaskListOptions{
+			Filters: filters.NewArgs(filters.Arg("service", serviceID)),
+		})
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("could not list tasks of hook: %w", err)
+		}
+		for _, task := range tasks {
+			switch task.Status.State {
+			case swarm.TaskStateComplete:
+				return nil
+			case swarm.TaskStateFailed, swarm.TaskStateRejected, swarm.TaskStateOrphaned:
+				return hookTaskError(task)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("hook timed out after %s: %w", timeout, ctx.Err())
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func hookTaskError(task swarm.Task) error {
+	if task.Status.ContainerStatus != nil && task.Status.ContainerStatus.ExitCode != 0 {
+		return fmt.Errorf("hook job exited with code %d", task.Status.ContainerStatus.ExitCode)
+	}
+	message := task.Status.Err
+	if message == "" {
+		message = task.Status.Message
+	}
+	return fmt.Errorf("hook job %s: %s", task.Status.State, message)
+}
+
+// hookLogs returns the last lines of the output of the hook job
+func hookLogs(ctx context.Context, apiClient client.APIClient, serviceID string) (string, error) {
+	reader, err := apiClient.ServiceLogs(ctx, serviceID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       hookLogsTail,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	var logs bytes.Buffer
+	_, err = stdcopy.StdCopy(&logs, &logs, reader)
+	return logs.String(), err
+}
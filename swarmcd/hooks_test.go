@@ -0,0 +1,232 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/docker/cli/cli/compose/convert"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/goccy/go-yaml"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+const hooksCompose = `
+services:
+  app:
+    image: app:1.0
+  migrate:
+    image: app:1.0
+    command: ["migrate", "up"]
+    labels:
+      swarmcd.hook: pre-sync
+  smoke-test:
+    image: curl
+    deploy:
+      labels:
+        - swarmcd.hook=post-sync
+`
+
+// Services labeled as hooks are removed from the compose file
+func TestExtractHooks(t *testing.T) {
+	var composeMap map[string]any
+	err := yaml.Unmarshal([]byte(hooksCompose), &composeMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := extractHooks(composeMap)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(hooks) != 2 || hooks[0].name != "migrate" || hooks[0].hook != hookPreSync || hooks[1].name != "smoke-test" || hooks[1].hook != hookPostSync {
+		t.Errorf("unexpected hooks: %+v", hooks)
+	}
+	services := composeMap["services"].(map[string]any)
+	if len(services) != 1 || services["app"] == nil {
+		t.Errorf("unexpected services left: %v", services)
+	}
+
+	services["broken"] = map[string]any{"image": "app:1.0", "labels": map[string]any{hookLabel: "pre-deploy"}}
+	_, err = extractHooks(composeMap)
+	if err == nil {
+		t.Errorf("expected an error for an invalid hook label")
+	}
+}
+
+func TestNewConfigHooks(t *testing.T) {
+	hooks, err := newConfigHooks("app", []*util.HookConfig{
+		{Name: "migrate", Hook: hookPreSync, Image: "app:1.0", Command: []string{"migrate", "up"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(hooks) != 1 || serviceLabel(hooks[0].service, hookLabel) != hookPreSync {
+		t.Errorf("unexpected hooks: %+v", hooks)
+	}
+	_, err = newConfigHooks("app", []*util.HookConfig{{Name: "migrate", Hook: "pre-deploy", Image: "app:1.0"}})
+	if err == nil {
+		t.Errorf("expected an error for an invalid hook")
+	}
+	_, err = newConfigHooks("app", []*util.HookConfig{{Name: "migrate", Hook: hookPreSync}})
+	if err == nil {
+		t.Errorf("expected an error for a hook without image")
+	}
+}
+
+// Hooks run as jobs of a single task that is never restarted
+func TestHookServiceSpec(t *testing.T) {
+	var composeMap map[string]any
+	err := yaml.Unmarshal([]byte(hooksCompose), &composeMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, _ := extractHooks(composeMap)
+	composeConfig, err := loadHookCompose(hooks[0], composeMap, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	apiClient, err := client.NewClientWithOpts(client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := hookServiceSpec(context.Background(), apiClient, convert.NewNamespace("app"), composeConfig, "migrate")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if spec.Name != "app_migrate" {
+		t.Errorf("unexpected service name: %s", spec.Name)
+	}
+	if job := spec.Mode.ReplicatedJob; job == nil || *job.TotalCompletions != 1 {
+		t.Errorf("unexpected service mode: %+v", spec.Mode)
+	}
+	if spec.TaskTemplate.RestartPolicy.Condition != swarm.RestartPolicyConditionNone {
+		t.Errorf("unexpected restart policy: %+v", spec.TaskTemplate.RestartPolicy)
+	}
+	if command := spec.TaskTemplate.ContainerSpec.Args; len(command) != 2 || command[0] != "migrate" {
+		t.Errorf("unexpected command: %v", command)
+	}
+}
+
+// fakeTaskClient returns the given task states on successive task lists
+type fakeTaskClient struct {
+	client.APIClient
+	states []swarm.TaskState
+}
+
+func (fake *fakeTaskClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	state := fake.states[0]
+	if len(fake.states) > 1 {
+		fake.states = fake.states[1:]
+	}
+	task := swarm.Task{Status: swarm.TaskStatus{State: state}}
+	if state == swarm.TaskStateFailed {
+		task.Status.ContainerStatus = &swarm.ContainerStatus{ExitCode: 3}
+	}
+	return []swarm.Task{task}, nil
+}
+
+func TestWaitForHook(t *testing.T) {
+	hookPollInterval = time.Millisecond
+	defer func() { hookPollInterval = 2 * time.Second }()
+
+	fake := &fakeTaskClient{states: []swarm.TaskState{swarm.TaskStatePending, swarm.TaskStateRunning, swarm.TaskStateComplete}}
+	err := waitForHook(context.Background(), fake, "hook", time.Second)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	fake = &fakeTaskClient{states: []swarm.TaskState{swarm.TaskStateRunning, swarm.TaskStateFailed}}
+	err = waitForHook(context.Background(), fake, "hook", time.Second)
+	if err == nil || err.Error() != "hook job exited with code 3" {
+		t.Errorf("unexpected error of failed hook: %v", err)
+	}
+
+	fake = &fakeTaskClient{states: []swarm.TaskState{swarm.TaskStateRunning}}
+	err = waitForHook(context.Background(), fake, "hook", 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error of hung hook: %v", err)
+	}
+}
+
+// fakeObjectClient has the given configs and secrets and records the created ones
+type fakeObjectClient struct {
+	client.APIClient
+	existing []string
+	created  []string
+}
+
+func (fake *fakeObjectClient) SecretInspectWithRaw(ctx context.Context, name string) (swarm.Secret, []byte, error) {
+	if slices.Contains(fake.existing, name) {
+		return swarm.Secret{}, nil, nil
+	}
+	return swarm.Secret{}, nil, errdefs.NotFound(errors.New("no such secret"))
+}
+
+func (fake *fakeObjectClient) SecretCreate(ctx context.Context, spec swarm.SecretSpec) (types.SecretCreateResponse, error) {
+	fake.created = append(fake.created, spec.Name)
+	return types.SecretCreateResponse{}, nil
+}
+
+func (fake *fakeObjectClient) ConfigInspectWithRaw(ctx context.Context, name string) (swarm.Config, []byte, error) {
+	if slices.Contains(fake.existing, name) {
+		return swarm.Config{}, nil, nil
+	}
+	return swarm.Config{}, nil, errdefs.NotFound(errors.New("no such config"))
+}
+
+func (fake *fakeObjectClient) ConfigCreate(ctx context.Context, spec swarm.ConfigSpec) (types.ConfigCreateResponse, error) {
+	fake.created = append(fake.created, spec.Name)
+	return types.ConfigCreateResponse{}, nil
+}
+
+// Hooks can use the configs and secrets of the stack before its first deployment
+func TestCreateHookObjects(t *testing.T) {
+	workingDir := t.TempDir()
+	for _, file := range []string{"db-password", "app.conf", "other"} {
+		err := os.WriteFile(path.Join(workingDir, file), []byte(file), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var composeMap map[string]any
+	err := yaml.Unmarshal([]byte(`
+services:
+  migrate:
+    image: app:1.0
+    secrets: [db-password]
+    configs: [app-conf]
+    labels:
+      swarmcd.hook: pre-sync
+secrets:
+  db-password:
+    file: db-password
+  other:
+    file: other
+configs:
+  app-conf:
+    file: app.conf
+`), &composeMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, _ := extractHooks(composeMap)
+	composeConfig, err := loadHookCompose(hooks[0], composeMap, workingDir, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fake := &fakeObjectClient{existing: []string{"app_app-conf"}}
+	err = createHookObjects(context.Background(), fake, convert.NewNamespace("app"), composeConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !slices.Equal(fake.created, []string{"app_db-password"}) {
+		t.Errorf("unexpected created objects: %v", fake.created)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/docker/cli/cli/command"
 	"github.com/docker/cli/cli/flags"
@@ -14,9 +15,20 @@ import (
 )
 
 type StackStatus struct {
-	Error    string
-	Revision string
-	RepoURL  string
+	Status         string
+	Error          string
+	Revision       string
+	RepoURL        string
+	AutoSyncPaused bool
+	Drift          []DriftDiff
+	// why the stack is out of sync
+	Reason string
+	// hooks run by the last sync that ran hooks
+	Hooks []HookResult
+	// the end of the stderr of the last run of the stack renderer
+	RendererStderr string
+	// hash of the last deployed compose file
+	composeHash string
 }
 
 var config *util.Config = &util.Configs
@@ -28,6 +40,23 @@ var repos map[string]*stackRepo = map[string]*stackRepo{}
 var dockerCli *command.DockerCli
 
 func Init() (err error) {
+	events = newEventBroker(config.EventsBufferSize)
+	err = initTracing()
+	if err != nil {
+		return err
+	}
+	err = initNotifications()
+	if err != nil {
+		return err
+	}
+	err = initHistory()
+	if err != nil {
+		return err
+	}
+	err = initSyncWindows()
+	if err != nil {
+		return err
+	}
 	err = initRepos()
 	if err != nil {
 		return err
@@ -54,6 +83,20 @@ func initRepos() error {
 		if err != nil {
 			return err
 		}
+		repos[repoName].webhookSecret = repoConfig.WebhookSecret
+		if repoConfig.WebhookSecretFile != "" {
+			secretBytes, err := os.ReadFile(repoConfig.WebhookSecretFile)
+			if err != nil {
+				return fmt.Errorf("could not read webhook secret file %s for repo %s", repoConfig.WebhookSecretFile, repoName)
+			}
+			repos[repoName].webhookSecret = strings.TrimSpace(string(secretBytes))
+		}
+		if repoConfig.CommitStatus != nil {
+			repos[repoName].commitStatus, err = newCommitStatusReporter(repoName, repoConfig.Url, repoConfig.CommitStatus)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -92,20 +135,92 @@ func createHTTPBasicAuth(repoName string) (*http.BasicAuth, error) {
 }
 
 func initStacks() error {
-	for stack, stackConfig := range config.StackConfigs {
+	// stacks are updated in this order, after their dependencies
+	stackOrder, err := util.StackOrder(config.StackConfigs)
+	if err != nil {
+		return err
+	}
+	for _, stack := range stackOrder {
+		stackConfig := config.StackConfigs[stack]
 		stackRepo, ok := repos[stackConfig.Repo]
 		if !ok {
 			return fmt.Errorf("error initializing %s stack, no such repo: %s", stack, stackConfig.Repo)
 		}
 		discoverSecrets := config.SopsSecretsDiscovery || stackConfig.SopsSecretsDiscovery
-		swarmStack := newSwarmStack(stack, stackRepo, stackConfig.Branch, stackConfig.ComposeFile, stackConfig.SopsFiles, stackConfig.ValuesFile, discoverSecrets)
+		selfHeal := config.SelfHeal || stackConfig.SelfHeal
+		var composeFiles []string
+		if stackConfig.ComposeFile != "" {
+			composeFiles = append(composeFiles, stackConfig.ComposeFile)
+		}
+		composeFiles = append(composeFiles, stackConfig.ComposeFiles...)
+		if len(composeFiles) == 0 {
+			return fmt.Errorf("error initializing %s stack, no compose file", stack)
+		}
+		swarmStack := newSwarmStack(stack, stackRepo, stackConfig.Branch, composeFiles[0], stackConfig.SopsFiles, stackConfig.ValuesFile, discoverSecrets, selfHeal)
+		swarmStack.composeFiles = composeFiles
+		swarmStack.overlay = stackConfig.Overlay
+		if stackConfig.Renderer != "" {
+			swarmStack.rendererName = stackConfig.Renderer
+			swarmStack.renderer = config.Renderers[stackConfig.Renderer]
+			if swarmStack.renderer == nil || len(swarmStack.renderer.Command) == 0 {
+				return fmt.Errorf("error initializing %s stack, no such renderer: %s", stack, stackConfig.Renderer)
+			}
+			if len(composeFiles) > 1 {
+				return fmt.Errorf("error initializing %s stack, a renderer writes a single compose file", stack)
+			}
+		}
+		swarmStack.updateInterval = stackUpdateInterval(stackConfig)
+		swarmStack.project = stackConfig.Project
+		swarmStack.valuesFiles = stackConfig.ValuesFiles
+		swarmStack.encryptedValuesFiles = stackConfig.EncryptedValuesFiles
+		swarmStack.values = stackConfig.Values
+		swarmStack.strictTemplates = config.StrictTemplates || stackConfig.StrictTemplates
+		swarmStack.env = stackConfig.Env
+		swarmStack.envFiles = stackConfig.EnvFiles
+		swarmStack.templatesDir = stackConfig.TemplatesDir
+		if swarmStack.templatesDir == "" {
+			swarmStack.templatesDir = config.RepoConfigs[stackConfig.Repo].TemplatesDir
+		}
+		swarmStack.hooks, err = newConfigHooks(stack, stackConfig.Hooks)
+		if err != nil {
+			return err
+		}
+		for _, dependency := range stackConfig.DependsOn {
+			swarmStack.dependsOn = append(swarmStack.dependsOn, getSwarmStack(dependency))
+		}
 		stacks = append(stacks, swarmStack)
-		stackStatus[stack] = &StackStatus{}
+		stackStatus[stack] = &StackStatus{Status: StatusUnknown}
 		stackStatus[stack].RepoURL = stackRepo.url
+		err = restoreStackStatus(stack)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// stackUpdateInterval returns the update interval of the
+// stack, falling back to the one of its repo and the global one
+func stackUpdateInterval(stackConfig *util.StackConfig) time.Duration {
+	interval := config.UpdateInterval
+	if repoConfig := config.RepoConfigs[stackConfig.Repo]; repoConfig.UpdateInterval > 0 {
+		interval = repoConfig.UpdateInterval
+	}
+	if stackConfig.UpdateInterval > 0 {
+		interval = stackConfig.UpdateInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func initHistory() (err error) {
+	statePath := config.StatePath
+	if statePath == "" {
+		statePath = config.ReposPath
+	}
+	history, err = openHistoryStore(statePath, config.HistoryLimit)
+	return
+}
+
 func initDockerCli() (err error) {
 	// suppress command outputs (errors are returned as objects)
 	nullFile, _ := os.Open("/dev/null")
@@ -0,0 +1,313 @@
+package swarmcd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/docker/cli/opts"
+	"github.com/docker/go-connections/nat"
+)
+
+// mergeCompose merges an override compose file into base like docker
+// stack deploy merges multiple compose files. Mappings are merged
+// recursively and other values of override replace those of base,
+// with the exceptions of mergeService
+func mergeCompose(base map[string]any, override map[string]any) {
+	for key, value := range override {
+		baseServices, baseIsMap := base["services"].(map[string]any)
+		overrideServices, overrideIsMap := value.(map[string]any)
+		if key != "services" || !baseIsMap || !overrideIsMap {
+			mergeValues(base, map[string]any{key: value})
+			continue
+		}
+		for serviceName, service := range overrideServices {
+			baseService, baseIsMap := baseServices[serviceName].(map[string]any)
+			overrideService, overrideIsMap := service.(map[string]any)
+			if !baseIsMap || !overrideIsMap {
+				baseServices[serviceName] = service
+				continue
+			}
+			mergeService(baseService, overrideService)
+		}
+	}
+}
+
+// appendedServiceKeys are the lists of services that docker appends
+// the entries of override files to, instead of replacing them
+var appendedServiceKeys = []string{
+	"cap_add", "cap_drop", "devices", "dns", "dns_search", "env_file", "expose",
+	"external_links", "extra_hosts", "group_add", "links", "security_opt", "tmpfs",
+}
+
+// mergeService merges an override service into base. Environment, labels
+// and sysctls are merged by name, whether they are lists or mappings.
+// Ports are merged by published port, volumes, secrets and configs by
+// their target or source, networks by name, and the lists of
+// appendedServiceKeys are appended to. Command, entrypoint and other
+// lists are replaced
+func mergeService(base map[string]any, override map[string]any) {
+	for key, value := range override {
+		switch key {
+		case "environment", "labels", "sysctls":
+			base[key] = mergeMappings(base[key], value)
+		case "networks":
+			base[key] = mergeNetworks(base[key], value)
+		case "logging":
+			base[key] = mergeLogging(base[key], value)
+		case "ports":
+			base[key] = mergeSequences(normalizePorts(base[key]), normalizePorts(value), portKey)
+		case "volumes":
+			base[key] = mergeSequences(base[key], value, volumeKey)
+		case "secrets", "configs":
+			base[key] = mergeSequences(base[key], value, objectKey)
+		case "deploy":
+			baseDeploy, baseIsMap := base[key].(map[string]any)
+			overrideDeploy, overrideIsMap := value.(map[string]any)
+			if !baseIsMap || !overrideIsMap {
+				base[key] = value
+				continue
+			}
+			for deployKey, deployValue := range overrideDeploy {
+				switch deployKey {
+				case "labels":
+					baseDeploy[deployKey] = mergeMappings(baseDeploy[deployKey], deployValue)
+				case "placement":
+					basePlacement, baseIsMap := baseDeploy[deployKey].(map[string]any)
+					overridePlacement, overrideIsMap := deployValue.(map[string]any)
+					if !baseIsMap || !overrideIsMap {
+						baseDeploy[deployKey] = deployValue
+						continue
+					}
+					for placementKey, placementValue := range overridePlacement {
+						if placementKey == "constraints" || placementKey == "preferences" {
+							basePlacement[placementKey] = appendSequences(basePlacement[placementKey], placementValue)
+							continue
+						}
+						mergeValues(basePlacement, map[string]any{placementKey: placementValue})
+					}
+				default:
+					mergeValues(baseDeploy, map[string]any{deployKey: deployValue})
+				}
+			}
+		default:
+			if slices.Contains(appendedServiceKeys, key) {
+				base[key] = appendSequences(base[key], value)
+				continue
+			}
+			mergeValues(base, map[string]any{key: value})
+		}
+	}
+}
+
+// appendSequences appends the entries of override to base. Single strings,
+// as dns and env_file may be, are lists of one entry. Mappings, as
+// extra_hosts may be, are merged if both are mappings, otherwise
+// override replaces base
+func appendSequences(base any, override any) any {
+	baseMap, baseIsMap := base.(map[string]any)
+	overrideMap, overrideIsMap := override.(map[string]any)
+	if baseIsMap && overrideIsMap {
+		return mergeMappings(baseMap, overrideMap)
+	}
+	if baseIsMap || overrideIsMap {
+		return override
+	}
+	return append(toSequence(base), toSequence(override)...)
+}
+
+func toSequence(value any) []any {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		return value
+	default:
+		return []any{value}
+	}
+}
+
+// mergeNetworks merges the networks of services by name, whether they
+// are lists of names or mappings. Networks of override without settings
+// keep the settings of base, like aliases
+func mergeNetworks(base any, override any) map[string]any {
+	merged := toMapping(base)
+	for name, network := range toMapping(override) {
+		if network == nil && merged[name] != nil {
+			continue
+		}
+		merged[name] = network
+	}
+	return merged
+}
+
+// mergeLogging merges the logging options of services using the same
+// driver, or if either does not set one. A different driver replaces
+// the logging of base, options included
+func mergeLogging(base any, override any) any {
+	baseLogging, baseIsMap := base.(map[string]any)
+	overrideLogging, overrideIsMap := override.(map[string]any)
+	if !baseIsMap || !overrideIsMap {
+		return override
+	}
+	baseDriver, _ := baseLogging["driver"].(string)
+	overrideDriver, _ := overrideLogging["driver"].(string)
+	if baseDriver != "" && overrideDriver != "" && baseDriver != overrideDriver {
+		return override
+	}
+	merged := map[string]any{}
+	for key, value := range baseLogging {
+		merged[key] = value
+	}
+	if overrideDriver != "" {
+		merged["driver"] = overrideDriver
+	}
+	if options, ok := overrideLogging["options"]; ok {
+		merged["options"] = mergeMappings(baseLogging["options"], options)
+	}
+	return merged
+}
+
+// mergeMappings merges mappings that are either maps or lists of
+// key=value strings. The result is a map
+func mergeMappings(base any, override any) map[string]any {
+	merged := toMapping(base)
+	for key, value := range toMapping(override) {
+		merged[key] = value
+	}
+	return merged
+}
+
+func toMapping(value any) map[string]any {
+	mapping := map[string]any{}
+	switch value := value.(type) {
+	case map[string]any:
+		for key, entry := range value {
+			mapping[key] = entry
+		}
+	case []any:
+		for _, entry := range value {
+			key, entryValue, found := strings.Cut(fmt.Sprint(entry), "=")
+			if !found {
+				// variables without value are taken from the environment
+				mapping[key] = nil
+				continue
+			}
+			mapping[key] = entryValue
+		}
+	}
+	return mapping
+}
+
+// mergeSequences appends the entries of override to base,
+// entries of override replace the entries of base with the same key
+func mergeSequences(base any, override any, key func(entry any) string) []any {
+	baseEntries, _ := base.([]any)
+	overrideEntries, _ := override.([]any)
+	merged := make([]any, 0, len(baseEntries)+len(overrideEntries))
+	positions := map[string]int{}
+	for _, entry := range append(baseEntries, overrideEntries...) {
+		entryKey := key(entry)
+		if position, ok := positions[entryKey]; ok {
+			merged[position] = entry
+			continue
+		}
+		positions[entryKey] = len(merged)
+		merged = append(merged, entry)
+	}
+	return merged
+}
+
+// normalizePorts converts the ports in short syntax to the long syntax
+// like docker does, so they can be merged with ports in long syntax.
+// Ports that cannot be parsed, e.g. with variables, are kept as is
+func normalizePorts(ports any) any {
+	entries, ok := ports.([]any)
+	if !ok {
+		return ports
+	}
+	normalized := make([]any, 0, len(entries))
+	for _, entry := range entries {
+		if _, isMap := entry.(map[string]any); isMap {
+			normalized = append(normalized, entry)
+			continue
+		}
+		portConfigs, err := parsePort(fmt.Sprint(entry))
+		if err != nil {
+			normalized = append(normalized, entry)
+			continue
+		}
+		normalized = append(normalized, portConfigs...)
+	}
+	return normalized
+}
+
+func parsePort(port string) ([]any, error) {
+	exposedPorts, portBindings, err := nat.ParsePortSpecs([]string{port})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(exposedPorts))
+	for exposedPort := range exposedPorts {
+		keys = append(keys, string(exposedPort))
+	}
+	slices.Sort(keys)
+	var portConfigs []any
+	for _, key := range keys {
+		swarmPorts, err := opts.ConvertPortToPortConfig(nat.Port(key), portBindings)
+		if err != nil {
+			return nil, err
+		}
+		for _, swarmPort := range swarmPorts {
+			portConfig := map[string]any{
+				"target":   swarmPort.TargetPort,
+				"protocol": string(swarmPort.Protocol),
+				"mode":     string(swarmPort.PublishMode),
+			}
+			if swarmPort.PublishedPort != 0 {
+				portConfig["published"] = swarmPort.PublishedPort
+			}
+			portConfigs = append(portConfigs, portConfig)
+		}
+	}
+	return portConfigs, nil
+}
+
+// ports are identified by their published port and protocol, like
+// docker does, and unpublished ports by their target port and protocol
+func portKey(entry any) string {
+	port, ok := entry.(map[string]any)
+	if !ok {
+		return fmt.Sprint(entry)
+	}
+	protocol := port["protocol"]
+	if protocol == nil {
+		protocol = "tcp"
+	}
+	if published := port["published"]; published != nil && fmt.Sprint(published) != "0" {
+		return fmt.Sprintf("%v/%v", published, protocol)
+	}
+	return fmt.Sprintf(":%v/%v", port["target"], protocol)
+}
+
+// volumes are identified by their path in the container
+func volumeKey(entry any) string {
+	volume, ok := entry.(map[string]any)
+	if ok {
+		return fmt.Sprint(volume["target"])
+	}
+	parts := strings.Split(fmt.Sprint(entry), ":")
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return parts[1]
+}
+
+// secrets and configs are identified by the object they refer to
+func objectKey(entry any) string {
+	object, ok := entry.(map[string]any)
+	if ok {
+		return fmt.Sprint(object["source"])
+	}
+	return fmt.Sprint(entry)
+}
@@ -0,0 +1,195 @@
+package swarmcd
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Override files are merged like multiple compose files passed to docker stack deploy
+func TestParseStackFilesMerge(t *testing.T) {
+	stack := newSwarmStack("app", nil, "main", "compose.yaml", nil, "", false, false)
+	stack.composeFiles = []string{"compose.yaml", "compose.prod.yaml"}
+	composeMap, err := stack.parseStackFiles([][]byte{
+		[]byte(`services:
+  app:
+    image: app:1.0
+    command: ["serve", "--debug"]
+    environment:
+      - LOG_LEVEL=debug
+      - REGION=eu
+    ports:
+      - "8080:80"
+    volumes:
+      - data:/data
+    deploy:
+      replicas: 1
+      labels:
+        team: web
+  worker:
+    image: worker:1.0
+volumes:
+  data: {}`),
+		[]byte(`services:
+  app:
+    image: app:2.0
+    command: ["serve"]
+    environment:
+      LOG_LEVEL: info
+    ports:
+      - "8080:80"
+      - "8443:443"
+    volumes:
+      - prod-data:/data
+    deploy:
+      replicas: 3
+      labels:
+        - tier=frontend
+volumes:
+  prod-data:
+    driver: local`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	app := composeMap["services"].(map[string]any)["app"].(map[string]any)
+	expected := map[string]any{
+		"image":       "app:2.0",
+		"command":     []any{"serve"},
+		"environment": map[string]any{"LOG_LEVEL": "info", "REGION": "eu"},
+		"ports": []any{
+			map[string]any{"target": uint32(80), "published": uint32(8080), "protocol": "tcp", "mode": "ingress"},
+			map[string]any{"target": uint32(443), "published": uint32(8443), "protocol": "tcp", "mode": "ingress"},
+		},
+		"volumes": []any{"prod-data:/data"},
+		"deploy": map[string]any{
+			"replicas": uint64(3),
+			"labels":   map[string]any{"team": "web", "tier": "frontend"},
+		},
+	}
+	if !reflect.DeepEqual(app, expected) {
+		t.Errorf("unexpected merged service: %#v", app)
+	}
+	if composeMap["services"].(map[string]any)["worker"] == nil {
+		t.Errorf("service of the base file is missing")
+	}
+	if volumes := composeMap["volumes"].(map[string]any); len(volumes) != 2 {
+		t.Errorf("unexpected merged volumes: %v", volumes)
+	}
+}
+
+// Lists like extra_hosts and dns are appended to, like docker does
+func TestParseStackFilesMergeAppends(t *testing.T) {
+	stack := newSwarmStack("app", nil, "main", "compose.yaml", nil, "", false, false)
+	stack.composeFiles = []string{"compose.yaml", "compose.prod.yaml"}
+	composeMap, err := stack.parseStackFiles([][]byte{
+		[]byte(`services:
+  app:
+    image: app:1.0
+    extra_hosts:
+      - "db:10.0.0.2"
+    dns: 8.8.8.8
+    cap_add:
+      - NET_ADMIN
+    env_file: common.env
+    networks:
+      front:
+        aliases:
+          - web
+    logging:
+      driver: json-file
+      options:
+        max-size: 10m
+    deploy:
+      placement:
+        constraints:
+          - node.role == worker
+  worker:
+    image: worker:1.0
+    logging:
+      driver: json-file
+      options:
+        max-size: 10m`),
+		[]byte(`services:
+  app:
+    extra_hosts:
+      - "cache:10.0.0.3"
+    dns:
+      - 1.1.1.1
+    cap_add:
+      - SYS_TIME
+    env_file:
+      - prod.env
+    networks:
+      - front
+      - back
+    logging:
+      options:
+        max-file: "3"
+    deploy:
+      placement:
+        constraints:
+          - node.labels.zone == eu
+  worker:
+    logging:
+      driver: syslog
+      options:
+        syslog-address: udp://logs:514`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	services := composeMap["services"].(map[string]any)
+	app := services["app"].(map[string]any)
+	expected := map[string]any{
+		"image":       "app:1.0",
+		"extra_hosts": []any{"db:10.0.0.2", "cache:10.0.0.3"},
+		"dns":         []any{"8.8.8.8", "1.1.1.1"},
+		"cap_add":     []any{"NET_ADMIN", "SYS_TIME"},
+		"env_file":    []any{"common.env", "prod.env"},
+		"networks": map[string]any{
+			"front": map[string]any{"aliases": []any{"web"}},
+			"back":  nil,
+		},
+		"logging": map[string]any{
+			"driver":  "json-file",
+			"options": map[string]any{"max-size": "10m", "max-file": "3"},
+		},
+		"deploy": map[string]any{
+			"placement": map[string]any{
+				"constraints": []any{"node.role == worker", "node.labels.zone == eu"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(app, expected) {
+		t.Errorf("unexpected merged service: %#v", app)
+	}
+	expectedLogging := map[string]any{
+		"driver":  "syslog",
+		"options": map[string]any{"syslog-address": "udp://logs:514"},
+	}
+	if logging := services["worker"].(map[string]any)["logging"]; !reflect.DeepEqual(logging, expectedLogging) {
+		t.Errorf("unexpected logging of a different driver: %#v", logging)
+	}
+}
+
+// Ports are merged by published port and protocol, whatever their syntax
+func TestMergePorts(t *testing.T) {
+	base := map[string]any{"ports": []any{"80:80", "53:53/udp", map[string]any{"target": 443, "published": 443}, "9000"}}
+	mergeService(base, map[string]any{"ports": []any{
+		"80:8080",
+		map[string]any{"target": 5353, "published": "53", "protocol": "udp"},
+		"0.0.0.0:443:8443",
+		"9000",
+		"${DEBUG_PORT}:2345",
+	}})
+	expected := []any{
+		map[string]any{"target": uint32(8080), "published": uint32(80), "protocol": "tcp", "mode": "ingress"},
+		map[string]any{"target": 5353, "published": "53", "protocol": "udp"},
+		map[string]any{"target": uint32(8443), "published": uint32(443), "protocol": "tcp", "mode": "ingress"},
+		map[string]any{"target": uint32(9000), "protocol": "tcp", "mode": "ingress"},
+		"${DEBUG_PORT}:2345",
+	}
+	if !reflect.DeepEqual(base["ports"], expected) {
+		t.Errorf("unexpected merged ports: %#v", base["ports"])
+	}
+}
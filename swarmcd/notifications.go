@@ -0,0 +1,401 @@
+package swarmcd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// events sent to notification targets that don't filter events
+var defaultNotificationEvents = []EventType{EventDeployError, EventRecovered, EventRollout, EventRollback}
+
+type notificationSender interface {
+	send(event Event) error
+}
+
+type notificationTarget struct {
+	name   string
+	stacks []string
+	events []EventType
+	sender notificationSender
+	// last error sent per stack, so the same failure
+	// is not sent again on every poll
+	lastErrors map[string]string
+	// events are sent from a goroutine per target, so a
+	// slow target does not delay the others
+	queue chan Event
+}
+
+// events waiting to be sent to a target, more are dropped
+const notificationQueueSize = 100
+
+var notificationTargets []*notificationTarget
+
+var notificationClient = &http.Client{Timeout: 10 * time.Second}
+
+// smtpTimeout limits connecting to the SMTP server and the whole session
+var smtpTimeout = 30 * time.Second
+
+func initNotifications() error {
+	for _, notificationConfig := range config.Notifications {
+		target, err := newNotificationTarget(notificationConfig)
+		if err != nil {
+			return err
+		}
+		notificationTargets = append(notificationTargets, target)
+	}
+	for _, target := range notificationTargets {
+		go target.run()
+	}
+	if len(notificationTargets) != 0 {
+		subscriber, _ := events.subscribe(0)
+		go sendNotifications(subscriber)
+	}
+	return nil
+}
+
+func newNotificationTarget(notificationConfig *util.NotificationConfig) (*notificationTarget, error) {
+	target := &notificationTarget{
+		name:       notificationConfig.Name,
+		stacks:     notificationConfig.Stacks,
+		events:     defaultNotificationEvents,
+		lastErrors: map[string]string{},
+		queue:      make(chan Event, notificationQueueSize),
+	}
+	if len(notificationConfig.Events) != 0 {
+		target.events = nil
+		for _, event := range notificationConfig.Events {
+			target.events = append(target.events, EventType(event))
+		}
+	}
+	for _, pattern := range target.stacks {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid stack pattern %s in %s notification: %w", pattern, target.name, err)
+		}
+	}
+
+	if notificationConfig.Type != "email" && notificationConfig.Url == "" {
+		return nil, fmt.Errorf("invalid %s notification: you must set url", target.name)
+	}
+	var err error
+	switch notificationConfig.Type {
+	case "webhook":
+		target.sender, err = newWebhookSender(notificationConfig)
+	case "slack":
+		target.sender = &slackSender{url: notificationConfig.Url}
+	case "teams":
+		target.sender = &teamsSender{url: notificationConfig.Url}
+	case "email":
+		target.sender, err = newEmailSender(notificationConfig)
+	default:
+		err = fmt.Errorf("unknown type %s", notificationConfig.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s notification: %w", target.name, err)
+	}
+	return target, nil
+}
+
+func sendNotifications(subscriber chan Event) {
+	var lastEventID uint64
+	for {
+		for event := range subscriber {
+			lastEventID = event.ID
+			for _, target := range notificationTargets {
+				target.enqueue(event)
+			}
+		}
+		// dropped for being too slow, resubscribe and
+		// catch up on the events we missed
+		var replay []Event
+		subscriber, replay = events.subscribe(lastEventID)
+		for _, event := range replay {
+			lastEventID = event.ID
+			for _, target := range notificationTargets {
+				target.enqueue(event)
+			}
+		}
+	}
+}
+
+// enqueue queues an event to be sent to the target, without blocking
+func (target *notificationTarget) enqueue(event Event) {
+	select {
+	case target.queue <- event:
+	default:
+		logger.Error(fmt.Sprintf("%s notification queue is full, dropping event", target.name), "stack", event.Stack, "event", event.Type)
+	}
+}
+
+// run sends the queued events to the target
+func (target *notificationTarget) run() {
+	for event := range target.queue {
+		target.notify(event)
+	}
+}
+
+func (target *notificationTarget) notify(event Event) {
+	if !target.matchesStack(event.Stack) {
+		return
+	}
+	switch event.Type {
+	case EventDeployError:
+		duplicate := target.lastErrors[event.Stack] == event.Message
+		target.lastErrors[event.Stack] = event.Message
+		if duplicate {
+			return
+		}
+	case EventSyncFinished:
+		if event.Message != StatusFailed {
+			delete(target.lastErrors, event.Stack)
+		}
+	}
+	if !slices.Contains(target.events, event.Type) {
+		return
+	}
+	err := target.sender.send(event)
+	if err != nil {
+		logger.Error(fmt.Sprintf("could not send %s notification: %s", target.name, err), "stack", event.Stack)
+	}
+}
+
+func (target *notificationTarget) matchesStack(stackName string) bool {
+	if len(target.stacks) == 0 {
+		return true
+	}
+	for _, pattern := range target.stacks {
+		if matched, _ := path.Match(pattern, stackName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEventMessage(event Event) string {
+	switch event.Type {
+	case EventDeployError:
+		return fmt.Sprintf("Stack %s failed to sync: %s", event.Stack, event.Message)
+	case EventRecovered:
+		return fmt.Sprintf("Stack %s recovered at revision %s", event.Stack, event.Revision)
+	case EventRollout:
+		return fmt.Sprintf("Stack %s rolled out revision %s", event.Stack, event.Revision)
+	case EventRollback:
+		return fmt.Sprintf("Stack %s rolled back to revision %s", event.Stack, event.Revision)
+	default:
+		return fmt.Sprintf("Stack %s %s: %s", event.Stack, event.Type, event.Message)
+	}
+}
+
+func postJSON(url string, headers map[string]string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := notificationClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %s", response.Status)
+	}
+	return nil
+}
+
+type webhookSender struct {
+	url     string
+	headers map[string]string
+	body    *template.Template
+}
+
+func newWebhookSender(notificationConfig *util.NotificationConfig) (*webhookSender, error) {
+	sender := &webhookSender{url: notificationConfig.Url, headers: notificationConfig.Headers}
+	if notificationConfig.Body == "" {
+		return sender, nil
+	}
+	body, err := template.New(notificationConfig.Name).Funcs(template.FuncMap{
+		"json":    toJSON,
+		"message": formatEventMessage,
+	}).Parse(notificationConfig.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse body template: %w", err)
+	}
+	sender.body = body
+	return sender, nil
+}
+
+func (sender *webhookSender) send(event Event) error {
+	if sender.body == nil {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return postJSON(sender.url, sender.headers, body)
+	}
+	var body bytes.Buffer
+	err := sender.body.Execute(&body, event)
+	if err != nil {
+		return fmt.Errorf("could not render body template: %w", err)
+	}
+	return postJSON(sender.url, sender.headers, body.Bytes())
+}
+
+// toJSON lets webhook body templates safely embed strings in JSON
+func toJSON(value any) (string, error) {
+	valueBytes, err := json.Marshal(value)
+	return string(valueBytes), err
+}
+
+type slackSender struct {
+	url string
+}
+
+func (sender *slackSender) send(event Event) error {
+	body, err := json.Marshal(map[string]string{"text": formatEventMessage(event)})
+	if err != nil {
+		return err
+	}
+	return postJSON(sender.url, nil, body)
+}
+
+type teamsSender struct {
+	url string
+}
+
+func (sender *teamsSender) send(event Event) error {
+	message := formatEventMessage(event)
+	body, err := json.Marshal(map[string]string{
+		"@type":    "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"summary":  message,
+		"text":     message,
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(sender.url, nil, body)
+}
+
+type emailSender struct {
+	host    string
+	address string
+	auth    smtp.Auth
+	from    string
+	to      []string
+}
+
+func newEmailSender(notificationConfig *util.NotificationConfig) (*emailSender, error) {
+	if notificationConfig.SmtpHost == "" || notificationConfig.From == "" || len(notificationConfig.To) == 0 {
+		return nil, fmt.Errorf("you must set smtp_host, from and to")
+	}
+	port := notificationConfig.SmtpPort
+	if port == 0 {
+		port = 25
+	}
+	sender := &emailSender{
+		host:    notificationConfig.SmtpHost,
+		address: net.JoinHostPort(notificationConfig.SmtpHost, strconv.Itoa(port)),
+		from:    notificationConfig.From,
+		to:      notificationConfig.To,
+	}
+	if notificationConfig.Username != "" {
+		password := notificationConfig.Password
+		if notificationConfig.PasswordFile != "" {
+			passwordBytes, err := os.ReadFile(notificationConfig.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read password file %s", notificationConfig.PasswordFile)
+			}
+			password = strings.TrimSpace(string(passwordBytes))
+		}
+		sender.auth = smtp.PlainAuth("", notificationConfig.Username, password, notificationConfig.SmtpHost)
+	}
+	return sender, nil
+}
+
+func (sender *emailSender) send(event Event) error {
+	message := formatEventMessage(event)
+	subject, _, _ := strings.Cut(message, ":")
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", sender.from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(sender.to, ", "))
+	fmt.Fprintf(&body, "Subject: [SwarmCD] %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n", message)
+	return sender.sendMail(body.Bytes())
+}
+
+// sendMail sends the message like smtp.SendMail does, with a timeout
+// on connecting and a deadline on the whole SMTP session
+func (sender *emailSender) sendMail(message []byte) error {
+	conn, err := net.DialTimeout("tcp", sender.address, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, sender.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: sender.host})
+		if err != nil {
+			return err
+		}
+	}
+	if sender.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp server doesn't support AUTH")
+		}
+		err = client.Auth(sender.auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(sender.from)
+	if err != nil {
+		return err
+	}
+	for _, to := range sender.to {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,209 @@
+package swarmcd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func newTestWebhookServer(t *testing.T) (*httptest.Server, chan string) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, bodies
+}
+
+// Webhook bodies are rendered from the configured template
+func TestWebhookNotification(t *testing.T) {
+	server, bodies := newTestWebhookServer(t)
+	target, err := newNotificationTarget(&util.NotificationConfig{
+		Name: "test",
+		Type: "webhook",
+		Url:  server.URL,
+		Body: `{"stack": {{ json .Stack }}, "text": {{ json (message .) }}}`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	target.notify(Event{Type: EventRollout, Stack: "test", Revision: "abcdef12"})
+	body := <-bodies
+	if body != `{"stack": "test", "text": "Stack test rolled out revision abcdef12"}` {
+		t.Errorf("unexpected webhook body: %s", body)
+	}
+}
+
+// Identical errors are only sent once until the stack recovers, other stacks are filtered out
+func TestSlackNotificationDeduplication(t *testing.T) {
+	server, bodies := newTestWebhookServer(t)
+	target, err := newNotificationTarget(&util.NotificationConfig{
+		Name:   "test",
+		Type:   "slack",
+		Url:    server.URL,
+		Stacks: []string{"app-*"},
+		Events: []string{string(EventDeployError)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	target.notify(Event{Type: EventDeployError, Stack: "app-1", Message: "boom"})
+	target.notify(Event{Type: EventDeployError, Stack: "app-1", Message: "boom"})
+	target.notify(Event{Type: EventDeployError, Stack: "other", Message: "boom"})
+	target.notify(Event{Type: EventSyncFinished, Stack: "app-1", Message: StatusSynced})
+	target.notify(Event{Type: EventDeployError, Stack: "app-1", Message: "boom"})
+	if len(bodies) != 2 {
+		t.Fatalf("unexpected number of notifications: %d", len(bodies))
+	}
+	body := <-bodies
+	if body != `{"text":"Stack app-1 failed to sync: boom"}` {
+		t.Errorf("unexpected slack body: %s", body)
+	}
+}
+
+// Emails are sent through SMTP
+func TestEmailNotification(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go serveTestSMTP(listener, messages)
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	smtpPort, _ := strconv.Atoi(port)
+	target, err := newNotificationTarget(&util.NotificationConfig{
+		Name:     "test",
+		Type:     "email",
+		SmtpHost: host,
+		SmtpPort: smtpPort,
+		From:     "swarm-cd@example.com",
+		To:       []string{"ops@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	target.notify(Event{Type: EventDeployError, Stack: "test", Message: "boom"})
+	message := <-messages
+	if !strings.Contains(message, "Subject: [SwarmCD] Stack test failed to sync") {
+		t.Errorf("unexpected email subject: %s", message)
+	}
+	if !strings.Contains(message, "Stack test failed to sync: boom") {
+		t.Errorf("unexpected email body: %s", message)
+	}
+}
+
+// SMTP servers that stop responding don't hang the notifications
+func TestEmailNotificationTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	defer func(timeout time.Duration) { smtpTimeout = timeout }(smtpTimeout)
+	smtpTimeout = 50 * time.Millisecond
+
+	sender := &emailSender{host: "127.0.0.1", address: listener.Addr().String(), from: "swarm-cd@example.com", to: []string{"ops@example.com"}}
+	start := time.Now()
+	err = sender.send(Event{Type: EventDeployError, Stack: "test", Message: "boom"})
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("unexpected result of hung smtp server after %s: %v", time.Since(start), err)
+	}
+}
+
+type blockingSender struct {
+	release chan struct{}
+	sent    chan Event
+}
+
+func (sender *blockingSender) send(event Event) error {
+	<-sender.release
+	sender.sent <- event
+	return nil
+}
+
+// Queuing events never blocks on slow targets, events are dropped instead
+func TestNotificationQueue(t *testing.T) {
+	sender := &blockingSender{release: make(chan struct{}), sent: make(chan Event, notificationQueueSize+2)}
+	target := &notificationTarget{
+		name:       "slow",
+		events:     []EventType{EventRollout},
+		sender:     sender,
+		lastErrors: map[string]string{},
+		queue:      make(chan Event, notificationQueueSize),
+	}
+	go target.run()
+	for i := 0; i < notificationQueueSize+10; i++ {
+		target.enqueue(Event{Type: EventRollout, Stack: "test"})
+	}
+	close(sender.release)
+	timeout := time.After(5 * time.Second)
+	for sent := 0; sent < notificationQueueSize; sent++ {
+		select {
+		case <-sender.sent:
+		case <-timeout:
+			t.Fatalf("only %d events were sent", sent)
+		}
+	}
+	close(target.queue)
+}
+
+// serveTestSMTP accepts a single SMTP session and sends the received message
+func serveTestSMTP(listener net.Listener, messages chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ESMTP")
+	var message strings.Builder
+	inData := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if inData {
+			if line == ".\r\n" {
+				inData = false
+				messages <- message.String()
+				reply("250 OK")
+				continue
+			}
+			message.WriteString(line)
+			continue
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case command == "DATA":
+			inData = true
+			reply("354 go ahead")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package swarmcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/goccy/go-yaml"
+)
+
+// composeOverlay patches the compose file of a stack for an
+// environment, like a kustomization patches kubernetes resources
+type composeOverlay struct {
+	Images       []overlayImage    `yaml:"images"`
+	CommonLabels map[string]string `yaml:"commonLabels"`
+	NamePrefix   string            `yaml:"namePrefix"`
+	Patches      []overlayPatch    `yaml:"patches"`
+}
+
+// overlayImage sets the name, tag or digest of the
+// images named name, whatever their tag or digest
+type overlayImage struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName"`
+	NewTag  string `yaml:"newTag"`
+	Digest  string `yaml:"digest"`
+}
+
+// overlayPatch applies JSON patch operations to a service
+type overlayPatch struct {
+	Service string `yaml:"service"`
+	Patch   []any  `yaml:"patch"`
+}
+
+// readOverlay reads the overlay file of the stack, if any
+func (swarmStack *swarmStack) readOverlay() (*composeOverlay, error) {
+	if swarmStack.overlay == "" {
+		return nil, nil
+	}
+	overlayBytes, err := os.ReadFile(path.Join(swarmStack.repo.path, swarmStack.overlay))
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s stack overlay file: %w", swarmStack.name, err)
+	}
+	overlay := &composeOverlay{}
+	err = yaml.UnmarshalWithOptions(overlayBytes, overlay, yaml.Strict())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s stack overlay file: %w", swarmStack.name, yamlError(swarmStack.overlay, err))
+	}
+	return overlay, nil
+}
+
+// applyOverlay applies the overlay file of the stack to the parsed compose file
+func (swarmStack *swarmStack) applyOverlay(composeMap map[string]any) error {
+	overlay, err := swarmStack.readOverlay()
+	if err != nil || overlay == nil {
+		return err
+	}
+	err = overlay.apply(composeMap)
+	if err != nil {
+		return fmt.Errorf("could not apply %s stack overlay: %w", swarmStack.name, err)
+	}
+	return nil
+}
+
+// apply patches the services of composeMap. Patches refer to the
+// services by their names in the base compose file, before the prefix
+func (overlay *composeOverlay) apply(composeMap map[string]any) error {
+	services, _ := composeMap["services"].(map[string]any)
+	for _, patch := range overlay.Patches {
+		service, ok := services[patch.Service]
+		if !ok {
+			return fmt.Errorf("could not patch service %s: no such service", patch.Service)
+		}
+		patched, err := patchService(service, patch.Patch)
+		if err != nil {
+			return fmt.Errorf("could not patch service %s: %w", patch.Service, err)
+		}
+		services[patch.Service] = patched
+	}
+	for _, service := range services {
+		service, ok := service.(map[string]any)
+		if !ok {
+			continue
+		}
+		if image, ok := service["image"].(string); ok {
+			service["image"] = overlay.setImage(image)
+		}
+		if len(overlay.CommonLabels) != 0 {
+			deploy, ok := service["deploy"].(map[string]any)
+			if !ok {
+				deploy = map[string]any{}
+				service["deploy"] = deploy
+			}
+			labels := toMapping(deploy["labels"])
+			for key, value := range overlay.CommonLabels {
+				labels[key] = value
+			}
+			deploy["labels"] = labels
+		}
+	}
+	if overlay.NamePrefix != "" && services != nil {
+		prefixed := make(map[string]any, len(services))
+		for serviceName, service := range services {
+			if service, ok := service.(map[string]any); ok {
+				overlay.prefixReferences(serviceName, service)
+			}
+			prefixed[overlay.NamePrefix+serviceName] = service
+		}
+		composeMap["services"] = prefixed
+	}
+	return nil
+}
+
+// prefixReferences prefixes the services that service depends on or
+// links to, and keeps service reachable by its unprefixed name, e.g.
+// from the urls in the environment of other services, by adding the
+// name as an alias on each of its networks
+func (overlay *composeOverlay) prefixReferences(serviceName string, service map[string]any) {
+	switch dependsOn := service["depends_on"].(type) {
+	case []any:
+		for i, dependency := range dependsOn {
+			dependsOn[i] = overlay.NamePrefix + fmt.Sprint(dependency)
+		}
+	case map[string]any:
+		prefixed := make(map[string]any, len(dependsOn))
+		for dependency, condition := range dependsOn {
+			prefixed[overlay.NamePrefix+dependency] = condition
+		}
+		service["depends_on"] = prefixed
+	}
+	if links, ok := service["links"].([]any); ok {
+		for i, link := range links {
+			target, alias, found := strings.Cut(fmt.Sprint(link), ":")
+			if !found {
+				alias = target
+			}
+			links[i] = overlay.NamePrefix + target + ":" + alias
+		}
+	}
+	networks := toMapping(service["networks"])
+	if len(networks) == 0 {
+		networks["default"] = nil
+	}
+	for networkName, network := range networks {
+		networkMap, _ := network.(map[string]any)
+		if networkMap == nil {
+			networkMap = map[string]any{}
+		}
+		aliases, _ := networkMap["aliases"].([]any)
+		if !slices.Contains(aliases, any(serviceName)) {
+			networkMap["aliases"] = append(aliases, serviceName)
+		}
+		networks[networkName] = networkMap
+	}
+	service["networks"] = networks
+}
+
+// patchService applies JSON patch operations to a service. The patched
+// service is parsed back as YAML so numbers stay integers
+func patchService(service any, operations []any) (any, error) {
+	serviceJSON, err := json.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+	operationsJSON, err := json.Marshal(operations)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.DecodePatch(operationsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	patchedJSON, err := patch.Apply(serviceJSON)
+	if err != nil {
+		return nil, err
+	}
+	var patched any
+	err = yaml.Unmarshal(patchedJSON, &patched)
+	if err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+// setImage returns image with the name, tag or digest
+// of the first overlay image with the same name
+func (overlay *composeOverlay) setImage(image string) string {
+	name, tag := splitImage(image)
+	for _, overlayImage := range overlay.Images {
+		if overlayImage.Name != name {
+			continue
+		}
+		if overlayImage.NewName != "" {
+			name = overlayImage.NewName
+		}
+		switch {
+		case overlayImage.Digest != "":
+			tag = "@" + overlayImage.Digest
+		case overlayImage.NewTag != "":
+			tag = ":" + overlayImage.NewTag
+		}
+		return name + tag
+	}
+	return image
+}
+
+// splitImage splits an image reference into its name and
+// its tag or digest, including the leading colon or at sign
+func splitImage(image string) (name string, tag string) {
+	if i := strings.Index(image, "@"); i != -1 {
+		return image[:i], image[i:]
+	}
+	// a colon before the last slash separates the registry port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i:]
+	}
+	return image, ""
+}
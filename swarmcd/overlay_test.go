@@ -0,0 +1,123 @@
+package swarmcd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyOverlay(t *testing.T) {
+	stack := newTemplateTestStack(t, map[string]string{
+		"prod.overlay.yaml": `images:
+  - name: registry.example.com:5000/app
+    newTag: "1.2.3"
+  - name: worker
+    newName: registry.example.com/worker
+    digest: sha256:abc
+commonLabels:
+  env: prod
+namePrefix: prod-
+patches:
+  - service: app
+    patch:
+      - op: replace
+        path: /deploy/replicas
+        value: 3
+      - op: add
+        path: /environment/-
+        value: LOG_LEVEL=info`,
+	})
+	stack.overlay = "prod.overlay.yaml"
+	composeMap, err := stack.parseStackString([]byte(`services:
+  app:
+    image: registry.example.com:5000/app:1.0
+    environment:
+      - REGION=eu
+    deploy:
+      replicas: 1
+      labels:
+        env: dev
+        team: web
+  worker:
+    image: worker`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stack.applyOverlay(composeMap)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	services := composeMap["services"].(map[string]any)
+	expected := map[string]any{
+		"image":       "registry.example.com:5000/app:1.2.3",
+		"environment": []any{"REGION=eu", "LOG_LEVEL=info"},
+		"deploy": map[string]any{
+			"replicas": uint64(3),
+			"labels":   map[string]any{"env": "prod", "team": "web"},
+		},
+		"networks": map[string]any{"default": map[string]any{"aliases": []any{"app"}}},
+	}
+	if !reflect.DeepEqual(services["prod-app"], expected) {
+		t.Errorf("unexpected patched service: %#v", services["prod-app"])
+	}
+	worker, _ := services["prod-worker"].(map[string]any)
+	if worker["image"] != "registry.example.com/worker@sha256:abc" {
+		t.Errorf("unexpected worker service: %#v", services["prod-worker"])
+	}
+
+	stack.overlay = "missing.overlay.yaml"
+	err = stack.applyOverlay(composeMap)
+	if err == nil {
+		t.Errorf("expected an error for a missing overlay file")
+	}
+}
+
+// Prefixed services keep their references and their DNS names
+func TestApplyOverlayNamePrefixReferences(t *testing.T) {
+	overlay := &composeOverlay{NamePrefix: "prod-"}
+	composeMap := map[string]any{"services": map[string]any{
+		"app": map[string]any{
+			"depends_on":  []any{"db"},
+			"links":       []any{"cache", "db:database"},
+			"networks":    []any{"front", "back"},
+			"environment": []any{"DB_URL=postgres://db:5432"},
+		},
+		"db": map[string]any{
+			"depends_on": map[string]any{"cache": map[string]any{"condition": "service_started"}},
+			"networks":   map[string]any{"back": map[string]any{"aliases": []any{"postgres"}}},
+		},
+		"cache": map[string]any{},
+	}}
+	err := overlay.apply(composeMap)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]any{
+		"prod-app": map[string]any{
+			"depends_on": []any{"prod-db"},
+			"links":      []any{"prod-cache:cache", "prod-db:database"},
+			"networks": map[string]any{
+				"front": map[string]any{"aliases": []any{"app"}},
+				"back":  map[string]any{"aliases": []any{"app"}},
+			},
+			"environment": []any{"DB_URL=postgres://db:5432"},
+		},
+		"prod-db": map[string]any{
+			"depends_on": map[string]any{"prod-cache": map[string]any{"condition": "service_started"}},
+			"networks":   map[string]any{"back": map[string]any{"aliases": []any{"postgres", "db"}}},
+		},
+		"prod-cache": map[string]any{
+			"networks": map[string]any{"default": map[string]any{"aliases": []any{"cache"}}},
+		},
+	}
+	if !reflect.DeepEqual(composeMap["services"], expected) {
+		t.Errorf("unexpected prefixed services: %#v", composeMap["services"])
+	}
+}
+
+func TestApplyOverlayUnknownService(t *testing.T) {
+	overlay := &composeOverlay{Patches: []overlayPatch{{Service: "db"}}}
+	err := overlay.apply(map[string]any{"services": map[string]any{"app": map[string]any{}}})
+	if err == nil || err.Error() != "could not patch service db: no such service" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
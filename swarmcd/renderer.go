@@ -0,0 +1,67 @@
+package swarmcd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// maxRendererStderr is how much of the end of the
+// stderr of a renderer is kept in the stack status
+const maxRendererStderr = 4096
+
+// rendererWaitDelay is how long a killed renderer may keep its
+// output open, e.g. through child processes, before it is abandoned
+var rendererWaitDelay = 5 * time.Second
+
+// runRenderer runs the renderer command of the stack in the repo
+// directory, with the stack metadata as SWARMCD_ variables and
+// only the PATH and HOME of the environment of SwarmCD. Its
+// stdout is the compose file of the stack. Returns the end of its
+// stderr along with the compose file, whether it failed or not.
+// The renderer is killed after timeout
+func (swarmStack *swarmStack) runRenderer(ctx context.Context, revision string, timeout time.Duration) ([]byte, string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	command := swarmStack.renderer.Command
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = swarmStack.repo.path
+	// renderers are repo controlled, they only get the environment
+	// they need to run, not the secrets in the environment of SwarmCD
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + os.Getenv("HOME"),
+		"SWARMCD_STACK_NAME=" + swarmStack.name,
+		"SWARMCD_STACK_BRANCH=" + swarmStack.branch,
+		"SWARMCD_STACK_REVISION=" + revision,
+		"SWARMCD_STACK_REPO=" + swarmStack.repo.name,
+		"SWARMCD_STACK_REPO_URL=" + swarmStack.repo.url,
+		"SWARMCD_STACK_COMPOSE_FILE=" + swarmStack.composePath,
+	}
+	cmd.WaitDelay = rendererWaitDelay
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	stderrTail := stderr.String()
+	if len(stderrTail) > maxRendererStderr {
+		stderrTail = stderrTail[len(stderrTail)-maxRendererStderr:]
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("renderer timed out after %s: %w", timeout, ctx.Err())
+	}
+	if err != nil {
+		return nil, stderrTail, fmt.Errorf("%s renderer of stack %s failed: %w", swarmStack.rendererName, swarmStack.name, err)
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, stderrTail, fmt.Errorf("%s renderer of stack %s wrote no compose file", swarmStack.rendererName, swarmStack.name)
+	}
+	return stdout.Bytes(), stderrTail, nil
+}
@@ -0,0 +1,77 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// The stdout of renderers is the compose file, their stderr is kept
+func TestRunRenderer(t *testing.T) {
+	t.Setenv("SWARMCD_TEST_TOKEN", "leaked")
+	stack := newTemplateTestStack(t, map[string]string{"image": "app:1.0"})
+	stack.rendererName = "script"
+	stack.renderer = &util.RendererConfig{Command: []string{"sh", "-c", `
+echo "rendering $SWARMCD_STACK_NAME at $SWARMCD_STACK_REVISION$SWARMCD_TEST_TOKEN" >&2
+printf 'services:\n  app:\n    image: %s\n' "$(cat image)"`}}
+	composeBytes, stderr, err := stack.runRenderer(context.Background(), "abcdef12", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(composeBytes) != "services:\n  app:\n    image: app:1.0\n" {
+		t.Errorf("unexpected compose file: %q", composeBytes)
+	}
+	if stderr != "rendering app at abcdef12\n" {
+		t.Errorf("unexpected stderr: %q", stderr)
+	}
+
+	stack.renderer.Command = []string{"sh", "-c", "echo 'no jsonnet' >&2; exit 1"}
+	_, stderr, err = stack.runRenderer(context.Background(), "abcdef12", time.Second)
+	if err == nil || stderr != "no jsonnet\n" {
+		t.Errorf("unexpected result of failed renderer: %q %v", stderr, err)
+	}
+
+	stack.renderer.Command = []string{"true"}
+	_, _, err = stack.runRenderer(context.Background(), "abcdef12", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "wrote no compose file") {
+		t.Errorf("unexpected error of empty renderer output: %v", err)
+	}
+}
+
+func TestRunRendererTimeout(t *testing.T) {
+	stack := newTemplateTestStack(t, nil)
+	stack.rendererName = "script"
+	stack.renderer = &util.RendererConfig{Command: []string{"sleep", "10"}}
+	_, _, err := stack.runRenderer(context.Background(), "abcdef12", 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error of hung renderer: %v", err)
+	}
+}
+
+// Compose files generated by renderers are written even if they are not committed
+func TestWriteRenderedStack(t *testing.T) {
+	stack := newTemplateTestStack(t, nil)
+	stack.composePath = "generated/docker-compose.yaml"
+	composeMap, err := stack.parseStackString([]byte("services:\n  app:\n    image: app:1.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	composeBytes, err := stack.marshalStack(composeMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stack.writeStack(composeBytes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fileInfo, err := os.Stat(path.Join(stack.repo.path, stack.composePath))
+	if err != nil || fileInfo.Mode() != 0o644 {
+		t.Errorf("unexpected compose file: %v %v", fileInfo, err)
+	}
+}
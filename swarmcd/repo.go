@@ -1,10 +1,13 @@
 package swarmcd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
@@ -18,6 +21,10 @@ type stackRepo struct {
 	gitRepoObject *git.Repository
 	auth          *http.BasicAuth
 	path          string
+	commitStatus  *commitStatusReporter
+	webhookSecret string
+	// set once the repo was cloned or pulled successfully
+	synced atomic.Bool
 }
 
 func newStackRepo(name string, path string, url string, auth *http.BasicAuth) (*stackRepo, error) {
@@ -27,7 +34,7 @@ func newStackRepo(name string, path string, url string, auth *http.BasicAuth) (*
 		Auth: auth,
 	}
 	repo, err := git.PlainClone(path, false, cloneOptions)
-
+	cloned := err == nil
 	if err != nil {
 		if errors.Is(err, git.ErrRepositoryAlreadyExists) {
 			repo, err = git.PlainOpen(path)
@@ -44,23 +51,26 @@ func newStackRepo(name string, path string, url string, auth *http.BasicAuth) (*
 			return nil, fmt.Errorf("could not clone repo %s: %w", name, err)
 		}
 	}
-	return &stackRepo{
+	stackRepo := &stackRepo{
 		name:          name,
 		path:          path,
 		url:           url,
 		auth:          auth,
 		lock:          &sync.Mutex{},
 		gitRepoObject: repo,
-	}, nil
+	}
+	// repos opened from a previous run are synced by their first pull
+	stackRepo.synced.Store(cloned)
+	return stackRepo, nil
 }
 
-func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
-	log := logger.With(slog.String("repo", repo.name), slog.String("branch", branch))
-
+// pullChanges checks out the latest commit of the
+// branch and returns its hash and message
+func (repo *stackRepo) pullChanges(ctx context.Context, branch string, log *slog.Logger) (commitHash string, commitMessage string, err error) {
 	log.Debug("getting repo worktree...")
 	workTree, err := repo.gitRepoObject.Worktree()
 	if err != nil {
-		return "", fmt.Errorf("could not get %s repo worktree: %w", repo.name, err)
+		return "", "", fmt.Errorf("could not get %s repo worktree: %w", repo.name, err)
 	}
 
 	log.Debug("checking out branch...")
@@ -69,7 +79,7 @@ func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
 		Force:  true,
 	})
 	if err != nil {
-		return "", fmt.Errorf("could not checkout branch %s in %s: %w", branch, repo.name, err)
+		return "", "", fmt.Errorf("could not checkout branch %s in %s: %w", branch, repo.name, err)
 	}
 
 	pullOptions := &git.PullOptions{
@@ -79,7 +89,7 @@ func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
 	}
 
 	log.Debug("pulling changes...")
-	err = workTree.Pull(pullOptions)
+	err = workTree.PullContext(ctx, pullOptions)
 	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
 		// we get this error when provided creds are invalid
 		// which can mislead users into thinking they
@@ -87,14 +97,82 @@ func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
 		if err.Error() == "authentication required" {
 			err = fmt.Errorf("authentication failed")
 		}
-		return "", fmt.Errorf("could not pull %s branch in %s repo: %w", branch, repo.name, err)
+		return "", "", fmt.Errorf("could not pull %s branch in %s repo: %w", branch, repo.name, err)
 	}
 
 	log.Debug("getting revision...")
 	ref, err := repo.gitRepoObject.Head()
 	if err != nil {
-		return "", fmt.Errorf("could not get HEAD commit hash of %s branch in %s repo: %w", branch, repo.name, err)
+		return "", "", fmt.Errorf("could not get HEAD commit hash of %s branch in %s repo: %w", branch, repo.name, err)
+	}
+	commit, err := repo.gitRepoObject.CommitObject(ref.Hash())
+	if err != nil {
+		return "", "", fmt.Errorf("could not get HEAD commit of %s branch in %s repo: %w", branch, repo.name, err)
+	}
+	commitMessage, _, _ = strings.Cut(commit.Message, "\n")
+	repo.synced.Store(true)
+	return ref.Hash().String(), commitMessage, nil
+}
+
+var errRevisionNotFound = errors.New("revision not found")
+
+// checkoutRevision checks out a specific commit, e.g. to redeploy
+// an earlier revision, and returns its hash and message. Returns
+// errRevisionNotFound when the commit is no longer in the repo,
+// which happens after force pushes
+func (repo *stackRepo) checkoutRevision(ctx context.Context, revision string, log *slog.Logger) (commitHash string, commitMessage string, err error) {
+	log.Debug("fetching changes...")
+	err = repo.fetch(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	log.Debug("resolving revision...")
+	hash, err := repo.gitRepoObject.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return "", "", fmt.Errorf("could not find revision %s in %s repo: %w", revision, repo.name, errRevisionNotFound)
+	}
+
+	log.Debug("getting repo worktree...")
+	workTree, err := repo.gitRepoObject.Worktree()
+	if err != nil {
+		return "", "", fmt.Errorf("could not get %s repo worktree: %w", repo.name, err)
+	}
+
+	log.Debug("checking out revision...")
+	err = workTree.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true})
+	if err != nil {
+		return "", "", fmt.Errorf("could not checkout revision %s in %s: %w", revision, repo.name, err)
+	}
+
+	commit, err := repo.gitRepoObject.CommitObject(*hash)
+	if err != nil {
+		return "", "", fmt.Errorf("could not get commit %s in %s repo: %w", revision, repo.name, err)
+	}
+	commitMessage, _, _ = strings.Cut(commit.Message, "\n")
+	return hash.String(), commitMessage, nil
+}
+
+// hasRevision checks that a revision is a commit of the repo,
+// fetching first as it may have been pushed since the last pull
+func (repo *stackRepo) hasRevision(ctx context.Context, revision string) (bool, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	err := repo.fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, err = repo.gitRepoObject.ResolveRevision(plumbing.Revision(revision))
+	return err == nil, nil
+}
+
+func (repo *stackRepo) fetch(ctx context.Context) error {
+	err := repo.gitRepoObject.FetchContext(ctx, &git.FetchOptions{RemoteName: "origin", Auth: repo.auth})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		if err.Error() == "authentication required" {
+			err = fmt.Errorf("authentication failed")
+		}
+		return fmt.Errorf("could not fetch %s repo: %w", repo.name, err)
 	}
-	// return HEAD commit short hash
-	return ref.Hash().String()[:8], nil
+	return nil
 }
@@ -0,0 +1,105 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// timeouts and backoffs are configured in seconds,
+// tests shorten them
+var durationUnit = time.Second
+
+// stageTimeout returns the timeout of a stage, 0 if it has none
+func stageTimeout(stage string) time.Duration {
+	var seconds int
+	switch stage {
+	case stagePull:
+		seconds = config.Timeouts.Git
+	case stageRender, stageRenderFiles:
+		seconds = config.Timeouts.Render
+	case stageDecrypt:
+		seconds = config.Timeouts.Decrypt
+	// drift detection calls the docker API like deploying does
+	case stageDiff, stageDeploy:
+		seconds = config.Timeouts.Deploy
+	case stagePreSync, stagePostSync:
+		seconds = config.Timeouts.Hook
+	case stageRenderer:
+		seconds = config.Timeouts.Renderer
+	}
+	return time.Duration(seconds) * durationUnit
+}
+
+// stages that reach remote services and may fail
+// transiently, e.g. on network errors
+func isRetryableStage(stage string) bool {
+	switch stage {
+	case stagePull, stageDecrypt, stageDiff, stageDeploy:
+		return true
+	}
+	return false
+}
+
+// runStage runs the operation of a stage within the stage timeout.
+// Failures of stages that reach remote services are retried with
+// exponential backoff and jitter
+func runStage(ctx context.Context, log *slog.Logger, stage string, operation func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := runWithTimeout(ctx, stage, operation)
+		if err == nil || !isRetryableStage(stage) || attempt >= config.Retry.Attempts || ctx.Err() != nil {
+			return err
+		}
+		delay := backoff(attempt)
+		log.Warn("stage failed, retrying", "attempt", attempt, "delay", delay.String(), "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// withStageTimeout returns a context canceled after the stage timeout
+func withStageTimeout(ctx context.Context, stage string) (context.Context, context.CancelFunc) {
+	timeout := stageTimeout(stage)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// runWithTimeout cancels the context of the operation after the stage
+// timeout. It waits for the operation to return, so that an attempt
+// never runs alongside the next one or after the repo lock is released.
+// Operations must return once their context is done, decryption gives
+// up on hung key services
+func runWithTimeout(ctx context.Context, stage string, operation func(ctx context.Context) error) error {
+	timeout := stageTimeout(stage)
+	stageCtx, cancel := withStageTimeout(ctx, stage)
+	defer cancel()
+	err := operation(stageCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(stageCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s stage timed out after %s: %w", stage, timeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// backoff doubles the delay on every attempt up to the maximum
+// backoff, half of it is random so that stacks failing together
+// do not retry together
+func backoff(attempt int) time.Duration {
+	delay := time.Duration(config.Retry.InitialBackoff) * durationUnit
+	maxDelay := time.Duration(config.Retry.MaxBackoff) * durationUnit
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,81 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func setTestRetryConfig(t *testing.T) {
+	previousConfig := *config
+	previousUnit := durationUnit
+	t.Cleanup(func() {
+		*config = previousConfig
+		durationUnit = previousUnit
+	})
+	durationUnit = time.Millisecond
+	config.Retry = util.RetryConfig{Attempts: 3, InitialBackoff: 1, MaxBackoff: 4}
+	config.Timeouts = util.TimeoutsConfig{Render: 10, Deploy: 1000}
+}
+
+// Transient failures of remote stages are retried, local stages are not
+func TestRunStageRetries(t *testing.T) {
+	setTestRetryConfig(t)
+	attempts := 0
+	err := runStage(context.Background(), logger, stageDeploy, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("unexpected result after %d attempts: %v", attempts, err)
+	}
+
+	attempts = 0
+	err = runStage(context.Background(), logger, stageRender, func(ctx context.Context) error {
+		attempts++
+		return errors.New("bad template")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("unexpected result after %d attempts: %v", attempts, err)
+	}
+}
+
+// Operations are cancelled after the stage timeout and
+// waited for before the stage fails or is retried
+func TestRunStageTimeout(t *testing.T) {
+	setTestRetryConfig(t)
+	config.Timeouts.Deploy = 10
+	running := 0
+	attempts := 0
+	err := runStage(context.Background(), logger, stageDeploy, func(ctx context.Context) error {
+		running++
+		attempts++
+		defer func() { running-- }()
+		if running > 1 {
+			t.Errorf("attempt %d runs alongside the previous one", attempts)
+		}
+		<-ctx.Done()
+		time.Sleep(5 * time.Millisecond)
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || attempts != 3 || running != 0 {
+		t.Errorf("unexpected result after %d attempts: %v", attempts, err)
+	}
+}
+
+// Backoffs grow exponentially up to the maximum, with jitter
+func TestBackoff(t *testing.T) {
+	setTestRetryConfig(t)
+	for attempt, maxDelay := range map[int]time.Duration{1: 1, 2: 2, 3: 4, 10: 4} {
+		delay := backoff(attempt)
+		if delay < maxDelay*time.Millisecond/2 || delay > maxDelay*time.Millisecond {
+			t.Errorf("unexpected backoff of attempt %d: %s", attempt, delay)
+		}
+	}
+}
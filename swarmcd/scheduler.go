@@ -0,0 +1,165 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("too many stack updates are queued")
+
+// updateRequest is a stack update waiting for a worker
+type updateRequest struct {
+	ctx     context.Context
+	stack   *swarmStack
+	trigger Trigger
+	update  updateFunc
+	// called after the update ran or was dropped
+	done func()
+}
+
+// maxQueuedUpdates is how many updates may wait for a worker
+const maxQueuedUpdates = 1000
+
+// scheduler starts the queued updates of all triggers: polls,
+// webhooks, manual syncs and rollbacks, on at most workers updates
+// at a time. An update waits for the earlier queued and the running
+// updates of its stack and of the stacks it depends on, so stacks
+// are updated one at a time and after their dependencies. Updates
+// waiting for a busy repo do not take a worker, so a slow repo
+// does not delay the stacks of the other repos
+var scheduler = struct {
+	lock    sync.Mutex
+	workers int
+	queue   []*updateRequest
+	running map[*swarmStack]bool
+}{running: map[*swarmStack]bool{}}
+
+// enqueueUpdate queues a stack update for the workers
+func enqueueUpdate(request *updateRequest) error {
+	if !trackSync() {
+		return ErrShuttingDown
+	}
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	if len(scheduler.queue) >= maxQueuedUpdates {
+		untrackSync()
+		return ErrQueueFull
+	}
+	scheduler.queue = append(scheduler.queue, request)
+	startUpdates()
+	return nil
+}
+
+// startWorkers starts updating the queued stacks,
+// limiting the number of stacks updated concurrently
+func startWorkers(workers int) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	scheduler.workers = max(workers, 1)
+	startUpdates()
+}
+
+// startUpdates starts the queued updates that can start, in
+// order, while workers are free. The caller must hold the lock
+func startUpdates() {
+	for i := 0; i < len(scheduler.queue) && len(scheduler.running) < scheduler.workers; {
+		request := scheduler.queue[i]
+		if !canStartUpdate(request, scheduler.queue[:i]) {
+			i++
+			continue
+		}
+		scheduler.queue = slices.Delete(scheduler.queue, i, i+1)
+		scheduler.running[request.stack] = true
+		go runUpdate(request)
+	}
+}
+
+// canStartUpdate returns whether no update of the stack or of the
+// stacks it depends on is running or queued before the request,
+// and no update of another stack of the same repo is running
+func canStartUpdate(request *updateRequest, queuedBefore []*updateRequest) bool {
+	for running := range scheduler.running {
+		if running.repo == request.stack.repo {
+			return false
+		}
+	}
+	for _, swarmStack := range append([]*swarmStack{request.stack}, request.stack.dependsOn...) {
+		if scheduler.running[swarmStack] {
+			return false
+		}
+		for _, queued := range queuedBefore {
+			if queued.stack == swarmStack {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func runUpdate(request *updateRequest) {
+	defer finishUpdate(request)
+	// updates queued before shutting down are dropped
+	if isShuttingDown() {
+		logger.Info(fmt.Sprintf("dropping queued update of %s stack, shutting down", request.stack.name))
+		return
+	}
+	ctx, cancel := detachContext(request.ctx)
+	defer cancel()
+	updateStackThread(ctx, request.stack, request.trigger, request.update)
+}
+
+// finishUpdate frees the worker of an update
+// and starts the updates that waited for it
+func finishUpdate(request *updateRequest) {
+	if request.done != nil {
+		request.done()
+	}
+	scheduler.lock.Lock()
+	delete(scheduler.running, request.stack)
+	startUpdates()
+	scheduler.lock.Unlock()
+	beat()
+	untrackSync()
+}
+
+// beatWhileWorkerFree beats while a worker is free to start updates.
+// While all workers are busy, only finished updates beat, so that
+// liveness fails when updates are stuck
+func beatWhileWorkerFree() {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	if len(scheduler.running) < scheduler.workers {
+		beat()
+	}
+}
+
+// schedulePolls queues a poll of every stack whose update interval
+// elapsed. A stack whose previous poll is still queued or running
+// is skipped, so a slow stack does not pile up updates
+func schedulePolls(ctx context.Context, now time.Time) {
+	for _, swarmStack := range stacks {
+		if now.Before(swarmStack.nextPoll) {
+			continue
+		}
+		swarmStack.nextPoll = now.Add(swarmStack.updateInterval)
+		if !swarmStack.polling.CompareAndSwap(false, true) {
+			logger.Warn(fmt.Sprintf("skipping %s stack, its previous update is still running", swarmStack.name))
+			continue
+		}
+		err := enqueueUpdate(&updateRequest{
+			ctx:     ctx,
+			stack:   swarmStack,
+			trigger: TriggerPoll,
+			update:  swarmStack.updateStack,
+			done:    func() { swarmStack.polling.Store(false) },
+		})
+		if err != nil {
+			swarmStack.polling.Store(false)
+			logger.Warn(fmt.Sprintf("could not queue update of %s stack: %s", swarmStack.name, err))
+		}
+	}
+}
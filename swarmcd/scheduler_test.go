@@ -0,0 +1,107 @@
+package swarmcd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// drainQueue removes and returns the queued updates
+func drainQueue() []*updateRequest {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	requests := scheduler.queue
+	scheduler.queue = nil
+	for range requests {
+		untrackSync()
+	}
+	return requests
+}
+
+// Stacks are polled on their own interval and are skipped while their previous poll is running
+func TestSchedulePolls(t *testing.T) {
+	fast := newSwarmStack("fast", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	fast.updateInterval = 10 * time.Second
+	slow := newSwarmStack("slow", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	slow.updateInterval = time.Minute
+	previousStacks := stacks
+	stacks = []*swarmStack{fast, slow}
+	defer func() { stacks = previousStacks }()
+
+	now := time.Now()
+	schedulePolls(context.Background(), now)
+	requests := drainQueue()
+	if len(requests) != 2 {
+		t.Fatalf("unexpected number of queued updates: %d", len(requests))
+	}
+
+	// the first poll of the fast stack is still running
+	schedulePolls(context.Background(), now.Add(10*time.Second))
+	if requests := drainQueue(); len(requests) != 0 {
+		t.Errorf("unexpected number of queued updates: %d", len(requests))
+	}
+	for _, request := range requests {
+		request.done()
+	}
+
+	schedulePolls(context.Background(), now.Add(20*time.Second))
+	requests = drainQueue()
+	if len(requests) != 1 || requests[0].stack != fast {
+		t.Errorf("unexpected queued updates: %v", requests)
+	}
+}
+
+// Updates wait for the queued and running updates of their stack and of its dependencies
+func TestCanStartUpdate(t *testing.T) {
+	traefik := newSwarmStack("traefik", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	app := newSwarmStack("app", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	app.dependsOn = []*swarmStack{traefik}
+	traefikPoll := &updateRequest{stack: traefik, trigger: TriggerPoll}
+	appPoll := &updateRequest{stack: app, trigger: TriggerPoll}
+
+	if canStartUpdate(appPoll, []*updateRequest{traefikPoll}) {
+		t.Errorf("update started before the queued update of its dependency")
+	}
+	if !canStartUpdate(traefikPoll, []*updateRequest{appPoll}) {
+		t.Errorf("update waits for the update of a dependent stack")
+	}
+
+	scheduler.lock.Lock()
+	scheduler.running[traefik] = true
+	scheduler.lock.Unlock()
+	defer func() {
+		scheduler.lock.Lock()
+		delete(scheduler.running, traefik)
+		scheduler.lock.Unlock()
+	}()
+	if canStartUpdate(appPoll, nil) {
+		t.Errorf("update started alongside the running update of its dependency")
+	}
+	if canStartUpdate(&updateRequest{stack: traefik, trigger: TriggerManual}, nil) {
+		t.Errorf("update started alongside the running update of its stack")
+	}
+}
+
+// Updates waiting for a busy repo do not take a worker from the stacks of other repos
+func TestStartUpdatesSkipsBusyRepos(t *testing.T) {
+	slowRepo := &stackRepo{name: "slow"}
+	fastRepo := &stackRepo{name: "fast"}
+	running := newSwarmStack("running", slowRepo, "main", "docker-compose.yaml", nil, "", false, false)
+	waiting := newSwarmStack("waiting", slowRepo, "main", "docker-compose.yaml", nil, "", false, false)
+	other := newSwarmStack("other", fastRepo, "main", "docker-compose.yaml", nil, "", false, false)
+
+	scheduler.lock.Lock()
+	scheduler.running[running] = true
+	scheduler.lock.Unlock()
+	defer func() {
+		scheduler.lock.Lock()
+		delete(scheduler.running, running)
+		scheduler.lock.Unlock()
+	}()
+	if canStartUpdate(&updateRequest{stack: waiting}, nil) {
+		t.Errorf("update started alongside a running update of its repo")
+	}
+	if !canStartUpdate(&updateRequest{stack: other}, []*updateRequest{{stack: waiting}}) {
+		t.Errorf("update waits for an update of another repo")
+	}
+}
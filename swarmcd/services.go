@@ -0,0 +1,195 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/cli/cli/compose/convert"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+var ErrStackNotFound = errors.New("no such stack")
+var ErrRepoNotFound = errors.New("no such repo")
+var ErrRevisionNotFound = errors.New("no such revision")
+
+type StackDetail struct {
+	Name                 string
+	Status               string
+	RepoURL              string
+	Revision             string
+	Error                string
+	AutoSyncPaused       bool
+	Drift                []DriftDiff
+	Reason               string
+	Hooks                []HookResult
+	RendererStderr       string
+	Project              string
+	Branch               string
+	ComposeFile          string
+	ComposeFiles         []string
+	Overlay              string
+	Renderer             string
+	ValuesFile           string
+	ValuesFiles          []string
+	EncryptedValuesFiles []string
+	Templated            bool
+	SopsFiles            []string
+	SopsSecretsDiscovery bool
+	SelfHeal             bool
+	Services             []ServiceDetail
+}
+
+type ServiceDetail struct {
+	Name            string
+	Image           string
+	Digest          string
+	RunningReplicas uint64
+	DesiredReplicas uint64
+	UpdateState     string
+	UpdateMessage   string
+	Tasks           []TaskDetail
+}
+
+type TaskDetail struct {
+	ID           string
+	Slot         int
+	NodeID       string
+	State        string
+	DesiredState string
+	Message      string
+	Error        string
+	Timestamp    time.Time
+}
+
+func GetStackDetail(ctx context.Context, name string, tasksLimit int) (*StackDetail, error) {
+	swarmStack := getSwarmStack(name)
+	if swarmStack == nil {
+		return nil, ErrStackNotFound
+	}
+	status := getStackStatus(name)
+	detail := &StackDetail{
+		Name:                 name,
+		Status:               status.Status,
+		RepoURL:              status.RepoURL,
+		Revision:             status.Revision,
+		Error:                status.Error,
+		AutoSyncPaused:       status.AutoSyncPaused,
+		Drift:                status.Drift,
+		Reason:               status.Reason,
+		Hooks:                status.Hooks,
+		RendererStderr:       status.RendererStderr,
+		Project:              swarmStack.project,
+		Branch:               swarmStack.branch,
+		ComposeFile:          swarmStack.composePath,
+		ComposeFiles:         swarmStack.composeFiles,
+		Overlay:              swarmStack.overlay,
+		Renderer:             swarmStack.rendererName,
+		ValuesFile:           swarmStack.valuesFile,
+		ValuesFiles:          swarmStack.valuesFiles,
+		EncryptedValuesFiles: swarmStack.encryptedValuesFiles,
+		Templated:            swarmStack.templated(),
+		SopsFiles:            swarmStack.sopsFiles,
+		SopsSecretsDiscovery: swarmStack.discoverSecrets,
+		SelfHeal:             swarmStack.selfHeal,
+	}
+	services, err := getStackServices(ctx, name, tasksLimit)
+	if err != nil {
+		return nil, err
+	}
+	detail.Services = services
+	return detail, nil
+}
+
+func getSwarmStack(name string) *swarmStack {
+	for _, swarmStack := range stacks {
+		if swarmStack.name == name {
+			return swarmStack
+		}
+	}
+	return nil
+}
+
+func getStackServices(ctx context.Context, stackName string, tasksLimit int) ([]ServiceDetail, error) {
+	client := dockerCli.Client()
+	services, err := client.ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", convert.LabelNamespace+"="+stackName)),
+		Status:  true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list services of stack %s: %w", stackName, err)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Spec.Name < services[j].Spec.Name
+	})
+	serviceDetails := make([]ServiceDetail, 0, len(services))
+	for _, service := range services {
+		serviceDetail := ServiceDetail{Name: service.Spec.Name}
+		if containerSpec := service.Spec.TaskTemplate.ContainerSpec; containerSpec != nil {
+			serviceDetail.Image, serviceDetail.Digest = splitImageDigest(containerSpec.Image)
+		}
+		if service.ServiceStatus != nil {
+			serviceDetail.RunningReplicas = service.ServiceStatus.RunningTasks
+			serviceDetail.DesiredReplicas = service.ServiceStatus.DesiredTasks
+		}
+		if service.UpdateStatus != nil {
+			serviceDetail.UpdateState = string(service.UpdateStatus.State)
+			serviceDetail.UpdateMessage = service.UpdateStatus.Message
+		}
+		serviceDetail.Tasks, err = getServiceTasks(ctx, service.ID, tasksLimit)
+		if err != nil {
+			return nil, err
+		}
+		serviceDetails = append(serviceDetails, serviceDetail)
+	}
+	return serviceDetails, nil
+}
+
+// getServiceTasks returns the most recent tasks of a service, newest first
+func getServiceTasks(ctx context.Context, serviceID string, limit int) ([]TaskDetail, error) {
+	tasks, err := dockerCli.Client().TaskList(ctx, types.TaskListOptions{
+		Filters: filters.NewArgs(filters.Arg("service", serviceID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list tasks of service %s: %w", serviceID, err)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Status.Timestamp.After(tasks[j].Status.Timestamp)
+	})
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	taskDetails := make([]TaskDetail, 0, len(tasks))
+	for _, task := range tasks {
+		taskDetails = append(taskDetails, newTaskDetail(task))
+	}
+	return taskDetails, nil
+}
+
+func newTaskDetail(task swarm.Task) TaskDetail {
+	return TaskDetail{
+		ID:           task.ID,
+		Slot:         task.Slot,
+		NodeID:       task.NodeID,
+		State:        string(task.Status.State),
+		DesiredState: string(task.DesiredState),
+		Message:      task.Status.Message,
+		Error:        task.Status.Err,
+		Timestamp:    task.Status.Timestamp,
+	}
+}
+
+// Swarm pins service images to a digest on deploy,
+// e.g. nginx:1.27@sha256:..., split it into image and digest
+func splitImageDigest(image string) (string, string) {
+	name, digest, found := strings.Cut(image, "@")
+	if !found {
+		return image, ""
+	}
+	return name, digest
+}
@@ -0,0 +1,79 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrShuttingDown = errors.New("SwarmCD is shutting down")
+
+// syncs tracks in-flight stack updates so that
+// shutting down can wait for them to finish
+var syncs struct {
+	lock     sync.Mutex
+	stopping bool
+	running  sync.WaitGroup
+}
+
+// abortCtx is cancelled when in-flight updates
+// do not finish within the shutdown grace period
+var abortCtx, abortSyncs = context.WithCancel(context.Background())
+
+// trackSync registers a new stack update. Returns false when
+// shutting down, otherwise the caller must call untrackSync
+func trackSync() bool {
+	syncs.lock.Lock()
+	defer syncs.lock.Unlock()
+	if syncs.stopping {
+		return false
+	}
+	syncs.running.Add(1)
+	return true
+}
+
+func isShuttingDown() bool {
+	syncs.lock.Lock()
+	defer syncs.lock.Unlock()
+	return syncs.stopping
+}
+
+func untrackSync() {
+	syncs.running.Done()
+}
+
+// detachContext returns a context that keeps the values of ctx, like
+// its span, but is only cancelled when in-flight updates are aborted.
+// Updates outlive the HTTP requests and the signals that trigger them
+func detachContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(abortCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Shutdown stops starting new stack updates and waits for in-flight
+// ones to finish. They are cancelled when ctx is done
+func Shutdown(ctx context.Context) error {
+	syncs.lock.Lock()
+	syncs.stopping = true
+	syncs.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		syncs.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Info("in-flight stack updates finished")
+	case <-ctx.Done():
+		logger.Warn("in-flight stack updates did not finish in time, cancelling them")
+		abortSyncs()
+		<-done
+	}
+	closeHistory()
+	return ctx.Err()
+}
@@ -0,0 +1,60 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-flight updates are cancelled after the grace period and no new updates are started
+func TestShutdownCancelsInFlightUpdates(t *testing.T) {
+	store, err := openHistoryStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	history = store
+	events = newEventBroker(10)
+	defer func() {
+		history = nil
+		syncs.stopping = false
+		abortCtx, abortSyncs = context.WithCancel(context.Background())
+	}()
+	repo := &stackRepo{name: "test", lock: &sync.Mutex{}}
+	stack := newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false, false)
+	stackStatus["test"] = &StackStatus{Status: StatusUnknown}
+	stacks = append(stacks, stack)
+	defer func() {
+		delete(stackStatus, "test")
+		stacks = stacks[:len(stacks)-1]
+	}()
+
+	started := make(chan struct{})
+	err = startUpdate(context.Background(), stack, TriggerManual, func(ctx context.Context, log *slog.Logger, trigger Trigger) (*syncResult, error) {
+		close(started)
+		<-ctx.Done()
+		return &syncResult{}, ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	startWorkers(1)
+	defer func() { scheduler.workers = 0 }()
+	<-started
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = Shutdown(shutdownCtx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if stackStatus["test"].Status != StatusFailed {
+		t.Errorf("unexpected status of cancelled update: %s", stackStatus["test"].Status)
+	}
+	err = SyncStack(context.Background(), "test", TriggerManual)
+	if !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("unexpected error when updating while shutting down: %v", err)
+	}
+}
@@ -1,126 +1,485 @@
 package swarmcd
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path"
-	"text/template"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/docker/cli/cli/command/stack"
+	"github.com/docker/cli/cli/command/stack/options"
+	stackswarm "github.com/docker/cli/cli/command/stack/swarm"
 	"github.com/goccy/go-yaml"
 	"github.com/m-adawi/swarm-cd/util"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type swarmStack struct {
-	name            string
-	repo            *stackRepo
-	branch          string
-	composePath     string
-	sopsFiles       []string
-	valuesFile      string
-	discoverSecrets bool
+	name                 string
+	repo                 *stackRepo
+	branch               string
+	composePath          string
+	composeFiles         []string
+	overlay              string
+	rendererName         string
+	renderer             *util.RendererConfig
+	sopsFiles            []string
+	valuesFile           string
+	valuesFiles          []string
+	encryptedValuesFiles []string
+	values               map[string]any
+	strictTemplates      bool
+	env                  map[string]string
+	envFiles             []string
+	templatesDir         string
+	discoverSecrets      bool
+	selfHeal             bool
+	project              string
+	hooks                []*stackHook
+	dependsOn            []*swarmStack
+	updateInterval       time.Duration
+	nextPoll             time.Time
+	// set while a poll of the stack is queued or running
+	polling atomic.Bool
+	// held while the stack is updated
+	syncLock sync.Mutex
+	// the last commit status reported to the git provider
+	lastCommitStatus struct {
+		commitHash string
+		state      string
+	}
 }
 
-func newSwarmStack(name string, repo *stackRepo, branch string, composePath string, sopsFiles []string, valuesFile string, discoverSecrets bool) *swarmStack {
+func newSwarmStack(name string, repo *stackRepo, branch string, composePath string, sopsFiles []string, valuesFile string, discoverSecrets bool, selfHeal bool) *swarmStack {
 	return &swarmStack{
 		name:            name,
 		repo:            repo,
 		branch:          branch,
 		composePath:     composePath,
+		composeFiles:    []string{composePath},
 		sopsFiles:       sopsFiles,
 		valuesFile:      valuesFile,
 		discoverSecrets: discoverSecrets,
+		selfHeal:        selfHeal,
 	}
 }
 
-func (swarmStack *swarmStack) updateStack() (revision string, err error) {
-	log := logger.With(
-		slog.String("stack", swarmStack.name),
-		slog.String("branch", swarmStack.branch),
-	)
+const (
+	stagePull        = "pull"
+	stageRead        = "read"
+	stageRenderer    = "renderer"
+	stageRender      = "render"
+	stageParse       = "parse"
+	stageDecrypt     = "decrypt"
+	stageRenderFiles = "render-files"
+	stageRotate      = "rotate"
+	stageWrite       = "write"
+	stageDiff        = "diff"
+	stagePreSync     = "pre-sync"
+	stageDeploy      = "deploy"
+	stagePostSync    = "post-sync"
+)
+
+// syncResult describes a stack update. On failure, stage is
+// the stage that failed. drift and blocked are set when the
+// stack was left out of sync instead of being deployed
+type syncResult struct {
+	revision      string
+	commitHash    string
+	commitMessage string
+	stage         string
+	composeHash   string
+	composeBytes  []byte
+	drift         []DriftDiff
+	blocked       string
+	hooks         []HookResult
+	env           map[string]string
+	// set when the compose file was rendered with decrypted
+	// values, it is then neither written to disk nor stored
+	sensitive bool
+	// set when the stack renderer ran, even if it failed
+	rendererStderr *string
+	stageSpan      trace.Span
+}
+
+// enterStage records the stage the update is in, ends the span of
+// the previous stage and starts one for this stage. Returns the stage
+// context and a logger that tags log lines with the stage
+func (result *syncResult) enterStage(ctx context.Context, log *slog.Logger, stage string) (context.Context, *slog.Logger) {
+	result.endStage(nil)
+	result.stage = stage
+	ctx, result.stageSpan = tracer.Start(ctx, stage)
+	return ctx, log.With(slog.String("stage", stage))
+}
+
+// endStage ends the span of the current stage
+func (result *syncResult) endStage(err error) {
+	if result.stageSpan == nil {
+		return
+	}
+	endSpan(result.stageSpan, err)
+	result.stageSpan = nil
+}
 
-	log.Debug("pulling changes...")
-	revision, err = swarmStack.repo.pullChanges(swarmStack.branch)
+func (swarmStack *swarmStack) updateStack(ctx context.Context, log *slog.Logger, trigger Trigger) (result *syncResult, err error) {
+	result = &syncResult{}
+	log = log.With(slog.String("branch", swarmStack.branch))
+
+	stageCtx, stageLog := result.enterStage(ctx, log, stagePull)
+	stageLog.Debug("pulling changes...")
+	err = runStage(stageCtx, stageLog, stagePull, func(ctx context.Context) (err error) {
+		result.commitHash, result.commitMessage, err = swarmStack.repo.pullChanges(ctx, swarmStack.branch, stageLog)
+		return
+	})
 	if err != nil {
 		return
 	}
-	log.Debug("changes pulled", "revision", revision)
+	result.revision = result.commitHash[:8]
+	log = log.With(slog.String("revision", result.revision))
+	log.Debug("changes pulled")
 
-	log.Debug("reading stack file...")
-	stackBytes, err := swarmStack.readStack()
+	err = swarmStack.renderAndDeploy(ctx, result, log, trigger)
+	return
+}
+
+// rollbackStack redeploys an earlier revision. If the commit is gone
+// from the repo, the compose file stored when it was deployed is used
+func (swarmStack *swarmStack) rollbackStack(ctx context.Context, revision string, log *slog.Logger, trigger Trigger) (result *syncResult, err error) {
+	result = &syncResult{revision: revision}
+	log = log.With(slog.String("branch", swarmStack.branch))
+
+	stageCtx, stageLog := result.enterStage(ctx, log, stagePull)
+	stageLog.Debug("checking out revision...", "revision", revision)
+	err = runStage(stageCtx, stageLog, stagePull, func(ctx context.Context) (err error) {
+		result.commitHash, result.commitMessage, err = swarmStack.repo.checkoutRevision(ctx, revision, stageLog)
+		return
+	})
+	if errors.Is(err, errRevisionNotFound) {
+		log = log.With(slog.String("revision", revision))
+		log.Warn("revision is not in the repo anymore, using the stored compose file")
+		err = swarmStack.deployStoredCompose(ctx, revision, result, log, trigger)
+		return
+	}
 	if err != nil {
 		return
 	}
+	result.revision = result.commitHash[:8]
+	log = log.With(slog.String("revision", result.revision))
+
+	err = swarmStack.renderAndDeploy(ctx, result, log, trigger)
+	return
+}
 
-	if swarmStack.valuesFile != "" {
-		log.Debug("rendering template...")
-		stackBytes, err = swarmStack.renderComposeTemplate(stackBytes)
+// findRevision checks that a revision can be rolled back to, from
+// the repo or from the compose files stored in the history.
+// Returns ErrRevisionNotFound when it can not
+func (swarmStack *swarmStack) findRevision(ctx context.Context, revision string) error {
+	found, err := swarmStack.repo.hasRevision(ctx, revision)
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
 	}
+	_, _, err = history.findCompose(swarmStack.name, revision)
+	if err != nil {
+		return fmt.Errorf("could not find revision %s in %s repo: %w, %w", revision, swarmStack.repo.name, ErrRevisionNotFound, err)
+	}
+	return nil
+}
+
+func (swarmStack *swarmStack) deployStoredCompose(ctx context.Context, revision string, result *syncResult, log *slog.Logger, trigger Trigger) (err error) {
+	result.enterStage(ctx, log, stageRead)
+	entry, composeBytes, err := history.findCompose(swarmStack.name, revision)
 	if err != nil {
 		return
 	}
+	result.revision = entry.Revision
+	result.commitMessage = entry.CommitMessage
 
-	log.Debug("parsing stack content...")
-	stackContents, err := swarmStack.parseStackString([]byte(stackBytes))
+	// configs and secrets files are taken from the branch
+	stageCtx, stageLog := result.enterStage(ctx, log, stagePull)
+	stageLog.Debug("pulling changes...")
+	err = runStage(stageCtx, stageLog, stagePull, func(ctx context.Context) (err error) {
+		_, _, err = swarmStack.repo.pullChanges(ctx, swarmStack.branch, stageLog)
+		return
+	})
 	if err != nil {
 		return
 	}
 
-	log.Debug("decrypting secrets...")
-	err = swarmStack.decryptSopsFiles(stackContents)
+	_, stageLog = result.enterStage(ctx, log, stageRead)
+	stageLog.Debug("reading env files...")
+	result.env, err = swarmStack.readEnv(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt one or more sops files for %s stack: %w", swarmStack.name, err)
+		return
 	}
 
-	if config.AutoRotate {
-		log.Debug("rotating configs and secrets...")
-		err = swarmStack.rotateConfigsAndSecrets(stackContents)
+	_, stageLog = result.enterStage(ctx, log, stageParse)
+	stageLog.Debug("parsing stack content...")
+	stackContents, err := swarmStack.parseStackString(composeBytes)
+	if err != nil {
+		return
+	}
+
+	stageCtx, stageLog = result.enterStage(ctx, log, stageDecrypt)
+	stageLog.Debug("decrypting secrets...")
+	err = runStage(stageCtx, stageLog, stageDecrypt, func(ctx context.Context) error {
+		return swarmStack.decryptSopsFiles(ctx, stackContents, stageLog)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decrypt one or more sops files for %s stack: %w", swarmStack.name, err)
+	}
+
+	_, stageLog = result.enterStage(ctx, log, stageWrite)
+	stageLog.Debug("writing stack to file...")
+	result.composeBytes, err = swarmStack.marshalStack(stackContents)
+	if err != nil {
+		return
+	}
+	err = swarmStack.writeStack(result.composeBytes)
+	if err != nil {
+		return
+	}
+	result.composeHash = fmt.Sprintf("%x", sha256.Sum256(result.composeBytes))
+
+	if reason := swarmStack.blockingDeploy(ctx, trigger); reason != "" {
+		log.Info("skipping deployment", "reason", reason)
+		result.blocked = reason
+		return nil
+	}
+
+	// hook services are not stored, so no hooks are run, and
+	// config and secret templates are not rendered again
+	stageCtx, stageLog = result.enterStage(ctx, log, stageDeploy)
+	stageLog.Debug("deploying stack...")
+	return runStage(stageCtx, stageLog, stageDeploy, func(ctx context.Context) error {
+		return swarmStack.deployStack(ctx, result.composeBytes, result.env)
+	})
+}
+
+// renderAndDeploy deploys the stack from the checked out repo worktree
+func (swarmStack *swarmStack) renderAndDeploy(ctx context.Context, result *syncResult, log *slog.Logger, trigger Trigger) (err error) {
+	var stackFiles [][]byte
+	if swarmStack.renderer != nil {
+		stageCtx, stageLog := result.enterStage(ctx, log, stageRenderer)
+		stageLog.Debug("running renderer...", "renderer", swarmStack.rendererName)
+		var stderr string
+		stackFiles = make([][]byte, 1)
+		stackFiles[0], stderr, err = swarmStack.runRenderer(stageCtx, result.revision, stageTimeout(stageRenderer))
+		result.rendererStderr = &stderr
 		if err != nil {
 			return
 		}
 	}
 
-	log.Debug("writing stack to file...")
-	err = swarmStack.writeStack(stackContents)
+	stageCtx, stageLog := result.enterStage(ctx, log, stageRead)
+	if swarmStack.renderer == nil {
+		stageLog.Debug("reading stack file...")
+		stackFiles, err = swarmStack.readStack()
+		if err != nil {
+			return
+		}
+	}
+	result.env, err = swarmStack.readEnv(ctx)
 	if err != nil {
 		return
 	}
 
-	log.Debug("deploying stack...")
-	err = swarmStack.deployStack()
-	return
-}
+	var templateData map[string]any
+	if swarmStack.templated() {
+		stageCtx, stageLog = result.enterStage(ctx, log, stageRender)
+		stageLog.Debug("rendering template...")
+		err = runStage(stageCtx, stageLog, stageRender, func(ctx context.Context) (err error) {
+			templateData, result.sensitive, err = swarmStack.templateData(ctx, result.revision)
+			if err != nil {
+				return
+			}
+			for i, composeFile := range swarmStack.composeFiles {
+				stackFiles[i], err = swarmStack.renderComposeTemplate(composeFile, stackFiles[i], templateData)
+				if err != nil {
+					return
+				}
+			}
+			return
+		})
+	}
+	if err != nil {
+		return
+	}
 
-func (swarmStack *swarmStack) readStack() ([]byte, error) {
-	composeFile := path.Join(swarmStack.repo.path, swarmStack.composePath)
-	composeFileBytes, err := os.ReadFile(composeFile)
+	_, stageLog = result.enterStage(ctx, log, stageParse)
+	stageLog.Debug("parsing stack content...")
+	stackContents, err := swarmStack.parseStackFiles(stackFiles)
 	if err != nil {
-		return nil, fmt.Errorf("could not read compose file %s: %w", composeFile, err)
+		return
+	}
+	err = swarmStack.applyOverlay(stackContents)
+	if err != nil {
+		return
 	}
-	return composeFileBytes, nil
-}
 
-func (swarmStack *swarmStack) renderComposeTemplate(templateContents []byte) ([]byte, error) {
-	valuesFile := path.Join(swarmStack.repo.path, swarmStack.valuesFile)
-	valuesBytes, err := os.ReadFile(valuesFile)
+	stageCtx, stageLog = result.enterStage(ctx, log, stageDecrypt)
+	stageLog.Debug("decrypting secrets...")
+	err = runStage(stageCtx, stageLog, stageDecrypt, func(ctx context.Context) error {
+		return swarmStack.decryptSopsFiles(ctx, stackContents, stageLog)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("could not read %s stack values file: %w", swarmStack.name, err)
+		return fmt.Errorf("failed to decrypt one or more sops files for %s stack: %w", swarmStack.name, err)
 	}
-	var valuesMap map[string]any
-	yaml.Unmarshal(valuesBytes, &valuesMap)
-	templ, err := template.New(swarmStack.name).Parse(string(templateContents[:]))
+
+	objectTemplates, err := templatedObjects(stackContents, swarmStack.composePath)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse %s stack compose file as a Go template: %w", swarmStack.name, err)
+		return
+	}
+	if len(objectTemplates) != 0 {
+		stageCtx, stageLog = result.enterStage(ctx, log, stageRenderFiles)
+		stageLog.Debug("rendering config and secret templates...")
+		err = runStage(stageCtx, stageLog, stageRenderFiles, func(ctx context.Context) (err error) {
+			if templateData == nil {
+				templateData, result.sensitive, err = swarmStack.templateData(ctx, result.revision)
+				if err != nil {
+					return
+				}
+			}
+			return swarmStack.renderObjectTemplates(objectTemplates, templateData, result.sensitive, stageLog)
+		})
+		if err != nil {
+			return
+		}
 	}
-	var stackContents bytes.Buffer
-	err = templ.Execute(&stackContents, map[string]map[string]any{"Values": valuesMap})
+
+	if config.AutoRotate {
+		_, stageLog = result.enterStage(ctx, log, stageRotate)
+		stageLog.Debug("rotating configs and secrets...")
+		err = swarmStack.rotateConfigsAndSecrets(stackContents, stageLog)
+		if err != nil {
+			return
+		}
+	}
+
+	_, stageLog = result.enterStage(ctx, log, stageWrite)
+	stageLog.Debug("writing stack to file...")
+	// hook services are run as jobs instead of being deployed
+	composeHooks, err := extractHooks(stackContents)
 	if err != nil {
-		return nil, fmt.Errorf("error rending %s stack compose template: %w", swarmStack.name, err)
+		return
+	}
+	hooks := slices.Concat(composeHooks, swarmStack.hooks)
+	result.composeBytes, err = swarmStack.marshalStack(stackContents)
+	if err != nil {
+		return
 	}
-	return stackContents.Bytes(), nil
+	// compose files holding decrypted values stay in memory
+	if result.sensitive {
+		stageLog.Debug("not writing stack rendered with decrypted values")
+	} else {
+		err = swarmStack.writeStack(result.composeBytes)
+		if err != nil {
+			return
+		}
+	}
+	result.composeHash = fmt.Sprintf("%x", sha256.Sum256(result.composeBytes))
+
+	// nothing changed in git since the last deployment, changes
+	// to live services were made by hand and are reverted by
+	// deploying only if self healing is enabled
+	changed := result.composeHash != getStackStatus(swarmStack.name).composeHash
+	if !changed {
+		stageCtx, stageLog = result.enterStage(ctx, log, stageDiff)
+		stageLog.Debug("detecting drift...")
+		var drift []DriftDiff
+		err = runStage(stageCtx, stageLog, stageDiff, func(ctx context.Context) (err error) {
+			drift, err = swarmStack.detectDrift(ctx, result.composeBytes, result.env)
+			return
+		})
+		if err != nil {
+			return err
+		}
+		if len(drift) != 0 && !swarmStack.selfHeal {
+			stageLog.Warn("stack drifted from git, skipping deployment", "differences", len(drift))
+			result.drift = drift
+			return nil
+		}
+		if len(drift) != 0 {
+			stageLog.Info("stack drifted from git, self healing", "differences", len(drift))
+			changed = true
+		}
+	}
+
+	// changes are only deployed within the sync windows of the
+	// stack and once its dependencies are deployed and healthy
+	if reason := swarmStack.blockingDeploy(ctx, trigger); reason != "" {
+		if changed {
+			log.Info("skipping deployment", "reason", reason)
+			result.blocked = reason
+		}
+		return nil
+	}
+
+	swarmStack.reportCommitStatus(result.commitHash, commitStatePending, "Deploying stack "+swarmStack.name)
+	// hooks run when the stack changes and on manual syncs,
+	// not every time polling redeploys an unchanged stack
+	runHooks := len(hooks) != 0 && (changed || (trigger != TriggerPoll && trigger != TriggerWebhook))
+	if runHooks {
+		stageCtx, stageLog = result.enterStage(ctx, log, stagePreSync)
+		err = swarmStack.runHooks(stageCtx, hooks, hookPreSync, stackContents, result, stageLog)
+		if err != nil {
+			return
+		}
+	}
+
+	stageCtx, stageLog = result.enterStage(ctx, log, stageDeploy)
+	stageLog.Debug("deploying stack...")
+	err = runStage(stageCtx, stageLog, stageDeploy, func(ctx context.Context) error {
+		return swarmStack.deployStack(ctx, result.composeBytes, result.env)
+	})
+	if err != nil || !runHooks {
+		return
+	}
+
+	stageCtx, stageLog = result.enterStage(ctx, log, stagePostSync)
+	return swarmStack.runHooks(stageCtx, hooks, hookPostSync, stackContents, result, stageLog)
+}
+
+func (swarmStack *swarmStack) readStack() ([][]byte, error) {
+	var stackFiles [][]byte
+	for _, composePath := range swarmStack.composeFiles {
+		composeFile := path.Join(swarmStack.repo.path, composePath)
+		composeFileBytes, err := os.ReadFile(composeFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read compose file %s: %w", composeFile, err)
+		}
+		stackFiles = append(stackFiles, composeFileBytes)
+	}
+	return stackFiles, nil
+}
+
+// parseStackFiles parses the compose files of the stack and merges
+// them in order, like docker stack deploy with multiple compose files.
+// The merged compose file is written in place of the first one
+func (swarmStack *swarmStack) parseStackFiles(stackFiles [][]byte) (map[string]any, error) {
+	var composeMap map[string]any
+	for i, stackFile := range stackFiles {
+		fileMap, err := swarmStack.parseStackString(stackFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", swarmStack.composeFiles[i], err)
+		}
+		if composeMap == nil {
+			composeMap = fileMap
+			continue
+		}
+		mergeCompose(composeMap, fileMap)
+	}
+	return composeMap, nil
 }
 
 func (swarmStack *swarmStack) parseStackString(stackContent []byte) (map[string]any, error) {
@@ -132,7 +491,7 @@ func (swarmStack *swarmStack) parseStackString(stackContent []byte) (map[string]
 	return composeMap, nil
 }
 
-func (swarmStack *swarmStack) decryptSopsFiles(composeMap map[string]any) (err error) {
+func (swarmStack *swarmStack) decryptSopsFiles(ctx context.Context, composeMap map[string]any, log *slog.Logger) (err error) {
 	var sopsFiles []string
 	if !swarmStack.discoverSecrets {
 		sopsFiles = swarmStack.sopsFiles
@@ -142,15 +501,24 @@ func (swarmStack *swarmStack) decryptSopsFiles(composeMap map[string]any) (err e
 			return
 		}
 	}
-	log := logger.With(
-		slog.String("stack", swarmStack.name),
-		slog.String("branch", swarmStack.branch),
-	)
-	for _, sopsFile := range sopsFiles {
+	// files are decrypted in memory and written once all of them are
+	// decrypted, so that a retry after a failure finds them encrypted
+	plainFiles := make([][]byte, len(sopsFiles))
+	for i, sopsFile := range sopsFiles {
 		log.Debug("decrypting secret...", "secret", sopsFile)
-		err = util.DecryptFile(path.Join(swarmStack.repo.path, sopsFile))
+		encryptedBytes, err := os.ReadFile(path.Join(swarmStack.repo.path, sopsFile))
 		if err != nil {
-			return
+			return fmt.Errorf("could not read sops file %s: %w", sopsFile, err)
+		}
+		plainFiles[i], err = util.DecryptData(ctx, encryptedBytes, sopsFile)
+		if err != nil {
+			return err
+		}
+	}
+	for i, sopsFile := range sopsFiles {
+		err = os.WriteFile(path.Join(swarmStack.repo.path, sopsFile), plainFiles[i], 0o600)
+		if err != nil {
+			return fmt.Errorf("could not write decrypted sops file %s: %w", sopsFile, err)
 		}
 	}
 	return
@@ -179,15 +547,15 @@ func discoverSecrets(composeMap map[string]any, composePath string) ([]string, e
 	return sopsFiles, nil
 }
 
-func (swarmStack *swarmStack) rotateConfigsAndSecrets(composeMap map[string]any) error {
+func (swarmStack *swarmStack) rotateConfigsAndSecrets(composeMap map[string]any, log *slog.Logger) error {
 	if configs, ok := composeMap["configs"].(map[string]any); ok {
-		err := swarmStack.rotateObjects(configs, "configs")
+		err := swarmStack.rotateObjects(configs, "configs", log)
 		if err != nil {
 			return fmt.Errorf("could not rotate one or more config files of stack %s: %w", swarmStack.name, err)
 		}
 	}
 	if secrets, ok := composeMap["secrets"].(map[string]any); ok {
-		err := swarmStack.rotateObjects(secrets, "secrets")
+		err := swarmStack.rotateObjects(secrets, "secrets", log)
 		if err != nil {
 			return fmt.Errorf("could not rotate one or more secret files of stack %s: %w", swarmStack.name, err)
 		}
@@ -195,14 +563,10 @@ func (swarmStack *swarmStack) rotateConfigsAndSecrets(composeMap map[string]any)
 	return nil
 }
 
-func (swarmStack *swarmStack) rotateObjects(objects map[string]any, objectType string) error {
+func (swarmStack *swarmStack) rotateObjects(objects map[string]any, objectType string, log *slog.Logger) error {
 	objectsDir := path.Dir(path.Join(swarmStack.repo.path, swarmStack.composePath))
 	for objectName, object := range objects {
-		log := logger.With(
-			slog.String("stack", swarmStack.name),
-			slog.String("branch", swarmStack.branch),
-			slog.String(objectType, objectName),
-		)
+		log := log.With(slog.String(objectType, objectName))
 		objectMap, ok := object.(map[string]any)
 		if !ok {
 			return fmt.Errorf("invalid compose file: %s object must be a map", objectName)
@@ -230,29 +594,49 @@ func (swarmStack *swarmStack) rotateObjects(objects map[string]any, objectType s
 	return nil
 }
 
-func (swarmStack *swarmStack) writeStack(composeMap map[string]any) error {
+func (swarmStack *swarmStack) marshalStack(composeMap map[string]any) ([]byte, error) {
 	composeFileBytes, err := yaml.Marshal(composeMap)
 	if err != nil {
-		return fmt.Errorf("could not store compose file as yaml after calculating hashes for stack %s", swarmStack.name)
+		return nil, fmt.Errorf("could not store compose file as yaml after calculating hashes for stack %s", swarmStack.name)
 	}
+	return composeFileBytes, nil
+}
+
+// writeStack writes the compose file to the worktree, for
+// inspection, deployments use the compose file in memory
+func (swarmStack *swarmStack) writeStack(composeFileBytes []byte) error {
 	composeFile := path.Join(swarmStack.repo.path, swarmStack.composePath)
-	fileInfo, _ := os.Stat(composeFile)
-	os.WriteFile(composeFile, composeFileBytes, fileInfo.Mode())
+	// compose files generated by renderers are usually not committed
+	fileMode := os.FileMode(0o644)
+	fileInfo, err := os.Stat(composeFile)
+	if err == nil {
+		fileMode = fileInfo.Mode()
+	}
+	err = os.MkdirAll(path.Dir(composeFile), 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create directory of compose file %s: %w", composeFile, err)
+	}
+	err = os.WriteFile(composeFile, composeFileBytes, fileMode)
+	if err != nil {
+		return fmt.Errorf("could not write compose file %s: %w", composeFile, err)
+	}
 	return nil
 }
 
-func (swarmStack *swarmStack) deployStack() error {
-	cmd := stack.NewStackCommand(dockerCli)
-	cmd.SetArgs([]string{
-		"deploy", "--detach", "--with-registry-auth", "-c",
-		path.Join(swarmStack.repo.path, swarmStack.composePath),
-		swarmStack.name,
-	})
-	// To stop printing errors and
-	// usage message to stdout
-	cmd.SilenceErrors = true
-	cmd.SilenceUsage = true
-	err := cmd.Execute()
+// deployStack deploys the compose file like docker stack deploy
+// does, interpolating variables from the env of the stack
+func (swarmStack *swarmStack) deployStack(ctx context.Context, composeBytes []byte, env map[string]string) error {
+	composeConfig, err := swarmStack.loadComposeFile(composeBytes, env)
+	if err != nil {
+		return err
+	}
+	err = stackswarm.RunDeploy(ctx, dockerCli, pflag.NewFlagSet("deploy", pflag.ContinueOnError), &options.Deploy{
+		Composefiles:     []string{path.Join(swarmStack.repo.path, swarmStack.composePath)},
+		Namespace:        swarmStack.name,
+		SendRegistryAuth: true,
+		ResolveImage:     stackswarm.ResolveImageAlways,
+		Detach:           true,
+	}, composeConfig)
 	if err != nil {
 		return fmt.Errorf("could not deploy stack %s: %s", swarmStack.name, err)
 	}
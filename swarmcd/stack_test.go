@@ -1,18 +1,26 @@
 package swarmcd
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 // External objects are ignored by the rotation
 func TestRotateExternalObjects(t *testing.T) {
 	repo := &stackRepo{name: "test", path: "test", url: "", auth: nil, lock: &sync.Mutex{}, gitRepoObject: nil}
-	stack := newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false)
+	stack := newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false, false)
 	objects := map[string]any{
 		"my-secret": map[string]any{"external": true},
 	}
-	err := stack.rotateObjects(objects, "secrets")
+	err := stack.rotateObjects(objects, "secrets", logger)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -21,7 +29,7 @@ func TestRotateExternalObjects(t *testing.T) {
 // Secrets are discovered, external secrets are ignored
 func TestSecretDiscovery(t *testing.T) {
 	repo := &stackRepo{name: "test", path: "test", url: "", auth: nil, lock: &sync.Mutex{}, gitRepoObject: nil}
-	stack := newSwarmStack("test", repo, "main", "stacks/docker-compose.yaml", nil, "", false)
+	stack := newSwarmStack("test", repo, "main", "stacks/docker-compose.yaml", nil, "", false, false)
 	stackString := []byte(`services:
   my-service:
     image: my-image
@@ -48,3 +56,78 @@ secrets:
 		t.Errorf("unexpected sops file: %s", sopsFiles[0])
 	}
 }
+
+// Image digests pinned by swarm are split from the image reference
+func TestSplitImageDigest(t *testing.T) {
+	image, digest := splitImageDigest("nginx:1.27@sha256:abcdef")
+	if image != "nginx:1.27" || digest != "sha256:abcdef" {
+		t.Errorf("unexpected image and digest: %s %s", image, digest)
+	}
+	image, digest = splitImageDigest("nginx:1.27")
+	if image != "nginx:1.27" || digest != "" {
+		t.Errorf("unexpected image and digest: %s %s", image, digest)
+	}
+}
+
+// Rollbacks to unknown revisions are rejected without pausing the stack
+func TestRollbackUnknownRevision(t *testing.T) {
+	originPath := t.TempDir()
+	origin, err := git.PlainInit(originPath, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = os.WriteFile(path.Join(originPath, "docker-compose.yaml"), []byte("services: {}\n"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	workTree, err := origin.Worktree()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = workTree.Add("docker-compose.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	commitHash, err := workTree.Commit("add stack", &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	repo, err := newStackRepo("rollback-test", path.Join(t.TempDir(), "repo"), originPath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store, err := openHistoryStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	history = store
+	defer func() {
+		store.db.Close()
+		history = nil
+	}()
+	err = store.add("rollback-test", &HistoryEntry{Revision: "abcdef12", Outcome: OutcomeSuccess, ComposeHash: "hash"}, []byte("compose"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stack := newSwarmStack("rollback-test", repo, "master", "docker-compose.yaml", nil, "", false, false)
+	stackStatus["rollback-test"] = &StackStatus{Status: StatusSynced}
+	stacks = append(stacks, stack)
+	defer func() {
+		delete(stackStatus, "rollback-test")
+		stacks = stacks[:len(stacks)-1]
+	}()
+
+	err = RollbackStack(context.Background(), "rollback-test", "0123456789")
+	if !errors.Is(err, ErrRevisionNotFound) {
+		t.Errorf("unexpected error of unknown revision: %v", err)
+	}
+	if getStackStatus("rollback-test").AutoSyncPaused || store.isAutoSyncPaused("rollback-test") {
+		t.Errorf("unexpected paused stack after rolling back to an unknown revision")
+	}
+	for _, revision := range []string{commitHash.String()[:8], "abcdef12"} {
+		err = stack.findRevision(context.Background(), revision)
+		if err != nil {
+			t.Errorf("unexpected error of revision %s: %s", revision, err)
+		}
+	}
+}
@@ -1,48 +1,315 @@
 package swarmcd
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	StatusUnknown   = "Unknown"
+	StatusSynced    = "Synced"
+	StatusOutOfSync = "OutOfSync"
+	StatusFailed    = "Failed"
 )
 
 var stackStatus map[string]*StackStatus = map[string]*StackStatus{}
+
+// stackStatusLock guards stackStatus, which is written by the
+// workers updating stacks and read by other workers and by handlers
+var stackStatusLock sync.RWMutex
 var stacks []*swarmStack
 
-func Run() {
+// Run updates every stack on its own update interval until ctx is
+// done. Stacks are updated by a pool of workers, so a slow stack
+// does not delay the others
+func Run(ctx context.Context) {
 	logger.Info("starting SwarmCD")
+	startWorkers(config.Workers)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		var waitGroup sync.WaitGroup
-		logger.Info("updating stacks...")
-		for _, swarmStack := range stacks {
-			waitGroup.Add(1)
-			go updateStackThread(swarmStack, &waitGroup)
+		beatWhileWorkerFree()
+		schedulePolls(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			logger.Info("stopped updating stacks")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// startUpdate queues a stack update. The update span
+// is a child of the span in ctx, if any
+func startUpdate(ctx context.Context, swarmStack *swarmStack, trigger Trigger, update updateFunc) error {
+	return enqueueUpdate(&updateRequest{ctx: ctx, stack: swarmStack, trigger: trigger, update: update})
+}
+
+// SyncStack updates a stack outside the update interval
+func SyncStack(ctx context.Context, stackName string, trigger Trigger) error {
+	swarmStack := getSwarmStack(stackName)
+	if swarmStack == nil {
+		return ErrStackNotFound
+	}
+	return startUpdate(ctx, swarmStack, trigger, swarmStack.updateStack)
+}
+
+// SyncRepoStacks updates all stacks deployed from a repo
+// outside the update interval
+func SyncRepoStacks(ctx context.Context, repoName string, trigger Trigger) error {
+	if _, ok := repos[repoName]; !ok {
+		return ErrRepoNotFound
+	}
+	for _, swarmStack := range stacks {
+		if swarmStack.repo.name == repoName {
+			err := startUpdate(ctx, swarmStack, trigger, swarmStack.updateStack)
+			if err != nil {
+				return err
+			}
 		}
-		waitGroup.Wait()
-		logger.Info("waiting for the update interval")
-		time.Sleep(time.Duration(config.UpdateInterval) * time.Second)
 	}
+	return nil
+}
+
+// RollbackStack redeploys an earlier revision of a stack and pauses
+// its automatic updates, so it is not rolled forward on the next poll
+func RollbackStack(ctx context.Context, stackName string, revision string) error {
+	swarmStack := getSwarmStack(stackName)
+	if swarmStack == nil {
+		return ErrStackNotFound
+	}
+	if isShuttingDown() {
+		return ErrShuttingDown
+	}
+	err := swarmStack.findRevision(ctx, revision)
+	if err != nil {
+		return err
+	}
+	wasPaused := getStackStatus(stackName).AutoSyncPaused
+	err = setAutoSyncPaused(stackName, true)
+	if err != nil {
+		return err
+	}
+	err = startUpdate(ctx, swarmStack, TriggerRollback, func(ctx context.Context, log *slog.Logger, trigger Trigger) (*syncResult, error) {
+		return swarmStack.rollbackStack(ctx, revision, log, trigger)
+	})
+	// the stack is not paused by a rollback that was not queued
+	if err != nil && !wasPaused {
+		pauseErr := setAutoSyncPaused(stackName, false)
+		if pauseErr != nil {
+			logger.Error(pauseErr.Error())
+		}
+	}
+	return err
+}
+
+// ResumeAutoSync resumes automatic updates of a stack
+// paused by a rollback and updates it right away
+func ResumeAutoSync(ctx context.Context, stackName string) error {
+	if getSwarmStack(stackName) == nil {
+		return ErrStackNotFound
+	}
+	if isShuttingDown() {
+		return ErrShuttingDown
+	}
+	err := setAutoSyncPaused(stackName, false)
+	if err != nil {
+		return err
+	}
+	return SyncStack(ctx, stackName, TriggerManual)
+}
+
+func setAutoSyncPaused(stackName string, paused bool) error {
+	err := history.setAutoSyncPaused(stackName, paused)
+	if err != nil {
+		return fmt.Errorf("could not store auto sync state of %s stack: %w", stackName, err)
+	}
+	updateStackStatus(stackName, func(status *StackStatus) {
+		status.AutoSyncPaused = paused
+	})
+	return nil
 }
 
-func updateStackThread(swarmStack *swarmStack, waitGroup *sync.WaitGroup) {
+func updateStackThread(ctx context.Context, swarmStack *swarmStack, trigger Trigger, update updateFunc) {
+	ctx, span := tracer.Start(ctx, "update stack", trace.WithAttributes(
+		attribute.String("stack", swarmStack.name),
+		attribute.String("repo", swarmStack.repo.name),
+		attribute.String("trigger", string(trigger)),
+	))
+	defer span.End()
+
+	_, lockSpan := tracer.Start(ctx, "wait for repo lock")
 	repoLock := swarmStack.repo.lock
 	repoLock.Lock()
 	defer repoLock.Unlock()
-	defer waitGroup.Done()
+	lockSpan.End()
+	swarmStack.syncLock.Lock()
+	defer swarmStack.syncLock.Unlock()
+
+	// pushes do not roll a paused stack forward either
+	if (trigger == TriggerPoll || trigger == TriggerWebhook) && getStackStatus(swarmStack.name).AutoSyncPaused {
+		logger.Info(fmt.Sprintf("skipping %s stack, auto sync is paused", swarmStack.name))
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return
+	}
+	syncStack(ctx, swarmStack, trigger, update)
+}
 
-	logger.Info(fmt.Sprintf("updating %s stack", swarmStack.name))
-	revision, err := swarmStack.updateStack()
+// updateFunc updates a stack, e.g. to the latest revision or to an earlier one
+type updateFunc func(ctx context.Context, log *slog.Logger, trigger Trigger) (*syncResult, error)
+
+// syncStack runs a stack update and records its outcome.
+// The caller must hold the stack repo lock
+func syncStack(ctx context.Context, swarmStack *swarmStack, trigger Trigger, update updateFunc) {
+	// every log line of the update carries the sync id
+	// so that a single sync can be followed end to end
+	syncID := newSyncID()
+	log := logger.With(
+		slog.String("stack", swarmStack.name),
+		slog.String("repo", swarmStack.repo.name),
+		slog.String("sync_id", syncID),
+	)
+	log.Info(fmt.Sprintf("updating %s stack", swarmStack.name), "trigger", trigger)
+	publishEvent(EventSyncStarted, swarmStack.name, "", string(trigger))
+	historyEntry := &HistoryEntry{SyncID: syncID, Trigger: trigger, StartedAt: time.Now()}
+	result, err := update(ctx, log, trigger)
+	result.endStage(err)
+	log = log.With(slog.String("revision", result.revision))
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("sync_id", syncID), attribute.String("revision", result.revision))
+	historyEntry.FinishedAt = time.Now()
+	historyEntry.Revision = result.revision
+	historyEntry.CommitMessage = result.commitMessage
+	historyEntry.ComposeHash = result.composeHash
+	updateStackStatus(swarmStack.name, func(status *StackStatus) {
+		if len(result.hooks) != 0 {
+			status.Hooks = result.hooks
+		}
+		if result.rendererStderr != nil {
+			status.RendererStderr = *result.rendererStderr
+		}
+	})
 	if err != nil {
-		stackStatus[swarmStack.name].Error = err.Error()
-		logger.Error(err.Error())
+		historyEntry.Outcome = OutcomeFailure
+		historyEntry.FailedStage = result.stage
+		historyEntry.Error = err.Error()
+		recordHistory(swarmStack.name, historyEntry, nil)
+		swarmStack.reportCommitStatus(result.commitHash, commitStateFailure, err.Error())
+		setStackStatus(swarmStack.name, StatusFailed, result.revision, func(status *StackStatus) {
+			status.Error = err.Error()
+			status.Reason = ""
+		})
+		publishEvent(EventDeployError, swarmStack.name, result.revision, err.Error())
+		publishEvent(EventSyncFinished, swarmStack.name, result.revision, StatusFailed)
+		span.SetStatus(codes.Error, err.Error())
+		log.Error(err.Error(), "stage", result.stage)
+		return
+	}
+
+	if len(result.drift) != 0 || result.blocked != "" {
+		historyEntry.Outcome = OutcomeOutOfSync
+		recordHistory(swarmStack.name, historyEntry, nil)
+		setStackStatus(swarmStack.name, StatusOutOfSync, result.revision, func(status *StackStatus) {
+			status.Error = ""
+			status.Drift = result.drift
+			status.Reason = result.blocked
+			if result.blocked == "" {
+				status.Reason = "live services drifted from git"
+			}
+		})
+		publishEvent(EventSyncFinished, swarmStack.name, result.revision, StatusOutOfSync)
+		log.Info(fmt.Sprintf("%s stack is out of sync", swarmStack.name))
 		return
 	}
 
-	stackStatus[swarmStack.name].Error = ""
-	stackStatus[swarmStack.name].Revision = revision
-	logger.Info(fmt.Sprintf("done updating %s stack", swarmStack.name))
+	historyEntry.Outcome = OutcomeSuccess
+	// compose files rendered with decrypted values are not stored,
+	// these stacks can only be rolled back to revisions still in git
+	if result.sensitive {
+		recordHistory(swarmStack.name, historyEntry, nil)
+	} else {
+		recordHistory(swarmStack.name, historyEntry, result.composeBytes)
+	}
+	swarmStack.reportCommitStatus(result.commitHash, commitStateSuccess, "Deployed stack "+swarmStack.name)
+	var previousRevision string
+	setStackStatus(swarmStack.name, StatusSynced, result.revision, func(status *StackStatus) {
+		previousRevision = status.Revision
+		status.Drift = nil
+		status.Reason = ""
+		status.Error = ""
+		status.composeHash = result.composeHash
+		status.Revision = result.revision
+	})
+	if trigger == TriggerRollback {
+		publishEvent(EventRollback, swarmStack.name, result.revision, "previous revision: "+previousRevision)
+	} else if result.revision != previousRevision {
+		publishEvent(EventRollout, swarmStack.name, result.revision, "previous revision: "+previousRevision)
+	}
+	publishEvent(EventSyncFinished, swarmStack.name, result.revision, StatusSynced)
+	log.Info(fmt.Sprintf("done updating %s stack", swarmStack.name))
 }
 
-func GetStackStatus() map[string]*StackStatus {
-	return stackStatus
+func newSyncID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// failing to record history should not fail the sync itself
+func recordHistory(stackName string, entry *HistoryEntry, composeBytes []byte) {
+	err := history.add(stackName, entry, composeBytes)
+	if err != nil {
+		logger.Error(fmt.Sprintf("could not record history of %s stack: %s", stackName, err))
+	}
+}
+
+// setStackStatus updates the status of the stack along with the
+// changes of update, and publishes an event if the status changed
+func setStackStatus(stackName string, status string, revision string, update func(status *StackStatus)) {
+	var previousStatus string
+	updateStackStatus(stackName, func(stackStatus *StackStatus) {
+		previousStatus = stackStatus.Status
+		stackStatus.Status = status
+		update(stackStatus)
+	})
+	if status != previousStatus {
+		publishEvent(EventStatus, stackName, revision, status)
+	}
+	if previousStatus == StatusFailed && status == StatusSynced {
+		publishEvent(EventRecovered, stackName, revision, "")
+	}
+}
+
+// updateStackStatus changes the status of a stack under the lock
+func updateStackStatus(stackName string, update func(status *StackStatus)) {
+	stackStatusLock.Lock()
+	defer stackStatusLock.Unlock()
+	update(stackStatus[stackName])
+}
+
+// getStackStatus returns a copy of the status of a stack
+func getStackStatus(stackName string) StackStatus {
+	stackStatusLock.RLock()
+	defer stackStatusLock.RUnlock()
+	return *stackStatus[stackName]
+}
+
+// GetStackStatus returns a copy of the status of every stack
+func GetStackStatus() map[string]StackStatus {
+	stackStatusLock.RLock()
+	defer stackStatusLock.RUnlock()
+	statuses := make(map[string]StackStatus, len(stackStatus))
+	for stackName, status := range stackStatus {
+		statuses[stackName] = *status
+	}
+	return statuses
 }
@@ -0,0 +1,117 @@
+package swarmcd
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	syncWindowAllow = "allow"
+	syncWindowDeny  = "deny"
+)
+
+// syncWindow allows or denies deploying stacks while it is active,
+// for its duration after each time its cron schedule fires
+type syncWindow struct {
+	name       string
+	kind       string
+	schedule   cron.Schedule
+	duration   time.Duration
+	location   *time.Location
+	stacks     []string
+	projects   []string
+	manualSync bool
+}
+
+var syncWindows []*syncWindow
+
+func initSyncWindows() error {
+	for i, windowConfig := range config.SyncWindows {
+		name := windowConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if windowConfig.Kind != syncWindowAllow && windowConfig.Kind != syncWindowDeny {
+			return fmt.Errorf("invalid kind %s of sync window %s, must be one of allow or deny", windowConfig.Kind, name)
+		}
+		schedule, err := cron.ParseStandard(windowConfig.Schedule)
+		if err != nil {
+			return fmt.Errorf("invalid schedule of sync window %s: %w", name, err)
+		}
+		duration, err := time.ParseDuration(windowConfig.Duration)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid duration %s of sync window %s", windowConfig.Duration, name)
+		}
+		location, err := time.LoadLocation(windowConfig.TimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone of sync window %s: %w", name, err)
+		}
+		syncWindows = append(syncWindows, &syncWindow{
+			name:       name,
+			kind:       windowConfig.Kind,
+			schedule:   schedule,
+			duration:   duration,
+			location:   location,
+			stacks:     windowConfig.Stacks,
+			projects:   windowConfig.Projects,
+			manualSync: windowConfig.ManualSync,
+		})
+	}
+	return nil
+}
+
+// isActive tells whether the schedule fired within the window duration
+func (window *syncWindow) isActive(now time.Time) bool {
+	now = now.In(window.location)
+	return !window.schedule.Next(now.Add(-window.duration)).After(now)
+}
+
+// matches tells whether the window applies to the stack. Windows
+// without stacks and projects apply to all stacks
+func (window *syncWindow) matches(swarmStack *swarmStack) bool {
+	if len(window.stacks) == 0 && len(window.projects) == 0 {
+		return true
+	}
+	for _, pattern := range window.stacks {
+		if matched, _ := path.Match(pattern, swarmStack.name); matched {
+			return true
+		}
+	}
+	return swarmStack.project != "" && slices.Contains(window.projects, swarmStack.project)
+}
+
+// blockingSyncWindow returns why the stack must not be deployed now,
+// or an empty string if it can be. Deploying is blocked by an active
+// deny window, or when allow windows apply to the stack and none is
+// active. Manual syncs pass windows allowing them, overrides pass all
+func (swarmStack *swarmStack) blockingSyncWindow(trigger Trigger, now time.Time) string {
+	if trigger == TriggerOverride {
+		return ""
+	}
+	manual := trigger == TriggerManual || trigger == TriggerRollback
+	allowed := false
+	var allowWindows []string
+	for _, window := range syncWindows {
+		if !window.matches(swarmStack) {
+			continue
+		}
+		switch window.kind {
+		case syncWindowDeny:
+			if window.isActive(now) && !(manual && window.manualSync) {
+				return fmt.Sprintf("blocked by deny sync window %s", window.name)
+			}
+		case syncWindowAllow:
+			allowWindows = append(allowWindows, window.name)
+			allowed = allowed || window.isActive(now) || (manual && window.manualSync)
+		}
+	}
+	if len(allowWindows) != 0 && !allowed {
+		return fmt.Sprintf("outside of allow sync windows %s", strings.Join(allowWindows, ", "))
+	}
+	return ""
+}
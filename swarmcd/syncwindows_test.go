@@ -0,0 +1,86 @@
+package swarmcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func setTestSyncWindows(t *testing.T, windows []*util.SyncWindowConfig) {
+	previousWindows := config.SyncWindows
+	config.SyncWindows = windows
+	t.Cleanup(func() {
+		config.SyncWindows = previousWindows
+		syncWindows = nil
+	})
+	err := initSyncWindows()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Deny windows block deploys while active, unless overridden
+func TestDenySyncWindow(t *testing.T) {
+	setTestSyncWindows(t, []*util.SyncWindowConfig{
+		{Name: "holidays", Kind: "deny", Schedule: "0 0 24 12 *", Duration: "72h", TimeZone: "Europe/Berlin"},
+	})
+	stack := newSwarmStack("app", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	christmas := time.Date(2024, 12, 25, 10, 0, 0, 0, berlin)
+	if reason := stack.blockingSyncWindow(TriggerPoll, christmas); reason != "blocked by deny sync window holidays" {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+	if reason := stack.blockingSyncWindow(TriggerManual, christmas); reason == "" {
+		t.Errorf("unexpected manual sync during deny window")
+	}
+	if reason := stack.blockingSyncWindow(TriggerOverride, christmas); reason != "" {
+		t.Errorf("unexpected reason of override: %s", reason)
+	}
+	// the window ends 72 hours after midnight in Berlin, i.e. at 23:00 UTC
+	if reason := stack.blockingSyncWindow(TriggerPoll, time.Date(2024, 12, 26, 23, 30, 0, 0, time.UTC)); reason != "" {
+		t.Errorf("unexpected reason after the window: %s", reason)
+	}
+}
+
+// Allow windows only apply to the stacks and projects they match
+func TestAllowSyncWindow(t *testing.T) {
+	setTestSyncWindows(t, []*util.SyncWindowConfig{
+		{
+			Name:       "business-hours",
+			Kind:       "allow",
+			Schedule:   "0 9 * * 1-5",
+			Duration:   "8h",
+			TimeZone:   "America/New_York",
+			Stacks:     []string{"prod-*"},
+			Projects:   []string{"production"},
+			ManualSync: true,
+		},
+	})
+	newYork, _ := time.LoadLocation("America/New_York")
+	monday := time.Date(2024, 6, 3, 10, 0, 0, 0, newYork)
+	evening := time.Date(2024, 6, 3, 18, 0, 0, 0, newYork)
+
+	prodStack := newSwarmStack("prod-app", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	if reason := prodStack.blockingSyncWindow(TriggerPoll, monday); reason != "" {
+		t.Errorf("unexpected reason within the window: %s", reason)
+	}
+	if reason := prodStack.blockingSyncWindow(TriggerPoll, evening); reason != "outside of allow sync windows business-hours" {
+		t.Errorf("unexpected reason outside the window: %s", reason)
+	}
+	if reason := prodStack.blockingSyncWindow(TriggerManual, evening); reason != "" {
+		t.Errorf("unexpected reason of manual sync: %s", reason)
+	}
+
+	projectStack := newSwarmStack("api", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	projectStack.project = "production"
+	if reason := projectStack.blockingSyncWindow(TriggerWebhook, evening); reason == "" {
+		t.Errorf("unexpected deploy of project stack outside the window")
+	}
+
+	devStack := newSwarmStack("dev-app", nil, "main", "docker-compose.yaml", nil, "", false, false)
+	if reason := devStack.blockingSyncWindow(TriggerPoll, evening); reason != "" {
+		t.Errorf("unexpected reason of unmatched stack: %s", reason)
+	}
+}
@@ -0,0 +1,309 @@
+package swarmcd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/goccy/go-yaml"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// partial templates defining named templates for compose
+// templates to include, e.g. _helpers.tpl
+const partialsPattern = "*.tpl"
+
+const maxIncludeDepth = 100
+
+// config and secret files with this suffix are rendered as templates
+const templateSuffix = ".tmpl"
+
+// templateStack is the stack being rendered, available
+// to templates as .Stack alongside .Values
+type templateStack struct {
+	Name     string
+	Branch   string
+	Revision string
+	Repo     string
+}
+
+// templated tells whether the compose file of
+// the stack is rendered as a Go template
+func (swarmStack *swarmStack) templated() bool {
+	return swarmStack.valuesFile != "" || len(swarmStack.valuesFiles) != 0 ||
+		len(swarmStack.encryptedValuesFiles) != 0 || len(swarmStack.values) != 0
+}
+
+// templateData returns the data templates are rendered with, and
+// whether it holds values decrypted from sops encrypted values files
+func (swarmStack *swarmStack) templateData(ctx context.Context, revision string) (map[string]any, bool, error) {
+	valuesMap, decrypted, err := swarmStack.readValues(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return map[string]any{
+		"Values": valuesMap,
+		"Stack": templateStack{
+			Name:     swarmStack.name,
+			Branch:   swarmStack.branch,
+			Revision: revision,
+			Repo:     swarmStack.repo.name,
+		},
+	}, decrypted, nil
+}
+
+func (swarmStack *swarmStack) renderComposeTemplate(composeFile string, templateContents []byte, data map[string]any) ([]byte, error) {
+	// templates are named after the compose file so that
+	// errors point to the file, line and column at fault
+	templ, err := swarmStack.newTemplate(composeFile)
+	if err != nil {
+		return nil, err
+	}
+	templ, err = templ.Parse(string(templateContents[:]))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s stack compose file as a Go template: %w", swarmStack.name, err)
+	}
+	var stackContents bytes.Buffer
+	err = templ.Execute(&stackContents, data)
+	if err != nil {
+		return nil, fmt.Errorf("error rending %s stack compose template: %w", swarmStack.name, err)
+	}
+	return stackContents.Bytes(), nil
+}
+
+// templatedObjects returns the files of the configs and secrets marked
+// as templates, by a .tmpl suffix or by template: true. The template
+// key is removed from the compose file, it is not a compose key
+func templatedObjects(composeMap map[string]any, composePath string) ([]string, error) {
+	var objectFiles []string
+	for _, objectType := range []string{"configs", "secrets"} {
+		objects, ok := composeMap[objectType].(map[string]any)
+		if !ok {
+			continue
+		}
+		for objectName, object := range objects {
+			objectMap, ok := object.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid compose file: %s object must be a map", objectName)
+			}
+			isTemplate, _ := objectMap["template"].(bool)
+			delete(objectMap, "template")
+			objectFile, _ := objectMap["file"].(string)
+			if !isTemplate && !strings.HasSuffix(objectFile, templateSuffix) {
+				continue
+			}
+			if objectFile == "" {
+				return nil, fmt.Errorf("invalid compose file: %s template must have a file", objectName)
+			}
+			objectFiles = append(objectFiles, path.Join(path.Dir(composePath), objectFile))
+		}
+	}
+	slices.Sort(objectFiles)
+	return slices.Compact(objectFiles), nil
+}
+
+// renderObjectTemplates renders config and secret files in place, before
+// they are rotated so that their names change with the rendered content.
+// docker reads them from disk, so they cannot be rendered with values
+// decrypted from sops encrypted values files
+func (swarmStack *swarmStack) renderObjectTemplates(objectFiles []string, data map[string]any, decrypted bool, log *slog.Logger) error {
+	if decrypted {
+		return fmt.Errorf("could not render templates %s of %s stack: config and secret templates cannot use encrypted values files, their rendered files would be written to disk, use sops_files instead", strings.Join(objectFiles, ", "), swarmStack.name)
+	}
+	for _, objectFile := range objectFiles {
+		log.Debug("rendering template...", "file", objectFile)
+		filePath := path.Join(swarmStack.repo.path, objectFile)
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("could not read template %s: %w", objectFile, err)
+		}
+		templateContents, err := os.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("could not read template %s: %w", objectFile, err)
+		}
+		templ, err := swarmStack.newTemplate(objectFile)
+		if err != nil {
+			return err
+		}
+		templ, err = templ.Parse(string(templateContents))
+		if err != nil {
+			return fmt.Errorf("could not parse %s as a Go template: %w", objectFile, err)
+		}
+		var contents bytes.Buffer
+		err = templ.Execute(&contents, data)
+		if err != nil {
+			return fmt.Errorf("error rendering template %s: %w", objectFile, err)
+		}
+		err = os.WriteFile(filePath, contents.Bytes(), fileInfo.Mode())
+		if err != nil {
+			return fmt.Errorf("could not write rendered template %s: %w", objectFile, err)
+		}
+	}
+	return nil
+}
+
+// newTemplate creates a template with the template
+// functions and the partials of the stack
+func (swarmStack *swarmStack) newTemplate(name string) (*template.Template, error) {
+	templ := template.New(name)
+	templ.Funcs(templateFuncs(templ))
+	if swarmStack.strictTemplates {
+		templ.Option("missingkey=error")
+	}
+	if swarmStack.templatesDir != "" {
+		_, err := templ.ParseGlob(path.Join(swarmStack.repo.path, swarmStack.templatesDir, partialsPattern))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse template partials of %s stack: %w", swarmStack.name, err)
+		}
+	}
+	return templ, nil
+}
+
+// readValues deep merges the values files of the stack in order,
+// then the inline values of the stack config. Values files encrypted
+// with sops are decrypted in memory, never written to disk. Returns
+// whether any values file was decrypted
+func (swarmStack *swarmStack) readValues(ctx context.Context) (map[string]any, bool, error) {
+	var valuesFiles []string
+	if swarmStack.valuesFile != "" {
+		valuesFiles = append(valuesFiles, swarmStack.valuesFile)
+	}
+	valuesFiles = append(valuesFiles, swarmStack.valuesFiles...)
+	valuesFiles = append(valuesFiles, swarmStack.encryptedValuesFiles...)
+	values := map[string]any{}
+	decrypted := false
+	for _, valuesFile := range valuesFiles {
+		valuesBytes, err := os.ReadFile(path.Join(swarmStack.repo.path, valuesFile))
+		if err != nil {
+			return nil, false, fmt.Errorf("could not read %s stack values file: %w", swarmStack.name, err)
+		}
+		var valuesMap map[string]any
+		err = yaml.Unmarshal(valuesBytes, &valuesMap)
+		if err != nil {
+			return nil, false, fmt.Errorf("could not parse %s stack values file %w", swarmStack.name, yamlError(valuesFile, err))
+		}
+		if isSopsEncrypted(valuesMap) || slices.Contains(swarmStack.encryptedValuesFiles, valuesFile) {
+			valuesMap, err = decryptValues(ctx, valuesBytes, valuesFile)
+			if err != nil {
+				return nil, false, fmt.Errorf("could not decrypt %s stack values file: %w", swarmStack.name, err)
+			}
+			decrypted = true
+		}
+		mergeValues(values, valuesMap)
+	}
+	mergeValues(values, swarmStack.values)
+	return values, decrypted, nil
+}
+
+// isSopsEncrypted tells whether values have the metadata sops adds to
+// the files it encrypts, a sops map with the message authentication code
+func isSopsEncrypted(values map[string]any) bool {
+	metadata, ok := values["sops"].(map[string]any)
+	if !ok {
+		return false
+	}
+	_, ok = metadata["mac"]
+	return ok
+}
+
+func decryptValues(ctx context.Context, valuesBytes []byte, valuesFile string) (map[string]any, error) {
+	plainBytes, err := util.DecryptData(ctx, valuesBytes, valuesFile)
+	if err != nil {
+		return nil, err
+	}
+	var valuesMap map[string]any
+	err = yaml.Unmarshal(plainBytes, &valuesMap)
+	if err != nil {
+		return nil, yamlError(valuesFile, err)
+	}
+	return valuesMap, nil
+}
+
+// yamlError formats a yaml parse error as file:line:column: message,
+// without the excerpt of the source that the yaml library appends
+func yamlError(file string, err error) error {
+	message, _, _ := strings.Cut(err.Error(), "\n")
+	var line, column int
+	if n, _ := fmt.Sscanf(message, "[%d:%d]", &line, &column); n == 2 {
+		_, message, _ = strings.Cut(message, "] ")
+		return fmt.Errorf("%s:%d:%d: %s", file, line, column, message)
+	}
+	return fmt.Errorf("%s: %s", file, message)
+}
+
+// mergeValues merges src into dst. Maps are merged
+// recursively, other values of src replace those of dst
+func mergeValues(dst map[string]any, src map[string]any) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]any)
+		dstMap, dstIsMap := dst[key].(map[string]any)
+		if srcIsMap && dstIsMap {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+		if srcIsMap {
+			// copied so that later merges do not modify src
+			copied := map[string]any{}
+			mergeValues(copied, srcMap)
+			value = copied
+		}
+		dst[key] = value
+	}
+}
+
+// templateFuncs returns the hermetic sprig functions along with
+// the helm-like functions that sprig lacks. Functions reading the
+// environment of SwarmCD, the network, the clock or randomness are
+// left out. include executes the templates associated with templ
+func templateFuncs(templ *template.Template) template.FuncMap {
+	funcs := sprig.HermeticTxtFuncMap()
+	funcs["toYaml"] = toYaml
+	funcs["fromYaml"] = fromYaml
+	funcs["required"] = required
+	depth := 0
+	funcs["include"] = func(name string, data any) (string, error) {
+		// partials including each other would recurse forever
+		if depth >= maxIncludeDepth {
+			return "", fmt.Errorf("could not include %s, templates are nested more than %d times", name, maxIncludeDepth)
+		}
+		depth++
+		defer func() { depth-- }()
+		var contents strings.Builder
+		err := templ.ExecuteTemplate(&contents, name, data)
+		return contents.String(), err
+	}
+	return funcs
+}
+
+func toYaml(value any) (string, error) {
+	yamlBytes, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(yamlBytes), "\n"), nil
+}
+
+func fromYaml(value string) (map[string]any, error) {
+	var valueMap map[string]any
+	err := yaml.Unmarshal([]byte(value), &valueMap)
+	return valueMap, err
+}
+
+// required fails rendering with the message if the value is missing
+func required(message string, value any) (any, error) {
+	if value == nil {
+		return nil, errors.New(message)
+	}
+	if stringValue, ok := value.(string); ok && stringValue == "" {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
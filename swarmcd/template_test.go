@@ -0,0 +1,210 @@
+package swarmcd
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTemplateTestStack(t *testing.T, files map[string]string) *swarmStack {
+	repoPath := t.TempDir()
+	for name, content := range files {
+		err := os.WriteFile(path.Join(repoPath, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := &stackRepo{name: "infra", path: repoPath, lock: &sync.Mutex{}}
+	return newSwarmStack("app", repo, "main", "docker-compose.yaml", nil, "", false, false)
+}
+
+func renderTestTemplate(stack *swarmStack, template []byte) ([]byte, error) {
+	data, _, err := stack.templateData(context.Background(), "abcdef12")
+	if err != nil {
+		return nil, err
+	}
+	return stack.renderComposeTemplate(stack.composePath, template, data)
+}
+
+// Values files are deep merged in order, inline values override them
+func TestRenderComposeTemplateValues(t *testing.T) {
+	stack := newTemplateTestStack(t, map[string]string{
+		"values.yaml":      "image:\n  name: app\n  tag: \"1.0\"\nreplicas: 1\n",
+		"values-prod.yaml": "image:\n  tag: \"2.0\"\n",
+	})
+	stack.valuesFiles = []string{"values.yaml", "values-prod.yaml"}
+	stack.values = map[string]any{"replicas": 3}
+	template := "image: {{ .Values.image.name }}:{{ .Values.image.tag }}\n" +
+		"replicas: {{ .Values.replicas }}\n" +
+		"stack: {{ .Stack.Name }}-{{ .Stack.Branch }}-{{ .Stack.Revision }}-{{ .Stack.Repo }}\n"
+	rendered, err := renderTestTemplate(stack, []byte(template))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "image: app:2.0\nreplicas: 3\nstack: app-main-abcdef12-infra\n"
+	if string(rendered) != expected {
+		t.Errorf("unexpected rendered template: %q", rendered)
+	}
+}
+
+func TestRenderComposeTemplateFuncs(t *testing.T) {
+	stack := newTemplateTestStack(t, nil)
+	stack.values = map[string]any{"labels": map[string]any{"team": "web"}}
+	template := "port: {{ .Values.port | default 8080 }}\n" +
+		"labels:\n{{ .Values.labels | toYaml | indent 2 }}\n"
+	rendered, err := renderTestTemplate(stack, []byte(template))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "port: 8080\nlabels:\n  team: web\n"
+	if string(rendered) != expected {
+		t.Errorf("unexpected rendered template: %q", rendered)
+	}
+
+	_, err = renderTestTemplate(stack, []byte(`{{ required "image is required" .Values.image }}`))
+	if err == nil {
+		t.Errorf("expected an error for a missing required value")
+	}
+
+	// templates must not read the secrets in the environment of SwarmCD
+	_, err = renderTestTemplate(stack, []byte(`{{ env "HOME" }}`))
+	if err == nil {
+		t.Errorf("expected an error for the env function")
+	}
+}
+
+// Values parse errors point to the file, line and column
+func TestRenderComposeTemplateValuesError(t *testing.T) {
+	stack := newTemplateTestStack(t, map[string]string{"values.yaml": "image: app\n  tag: 1.0\n"})
+	stack.valuesFile = "values.yaml"
+	_, err := renderTestTemplate(stack, []byte("image: {{ .Values.image }}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "could not parse app stack values file values.yaml:1:") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Strict templates fail on missing keys with the location of the reference
+func TestRenderComposeTemplateStrict(t *testing.T) {
+	stack := newTemplateTestStack(t, nil)
+	stack.values = map[string]any{"image": "app"}
+	template := "image: {{ .Values.image }}\nreplicas: {{ .Values.replicas }}\n"
+	rendered, err := renderTestTemplate(stack, []byte(template))
+	if err != nil || string(rendered) != "image: app\nreplicas: <no value>\n" {
+		t.Errorf("unexpected rendered template: %q, %v", rendered, err)
+	}
+	stack.strictTemplates = true
+	_, err = renderTestTemplate(stack, []byte(template))
+	if err == nil || !strings.Contains(err.Error(), "docker-compose.yaml:2:20") || !strings.Contains(err.Error(), `"replicas"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Values files with sops metadata are decrypted before being merged
+func TestReadValuesDetectsSops(t *testing.T) {
+	stack := newTemplateTestStack(t, map[string]string{
+		"values.yaml":  "image: app\n",
+		"secrets.yaml": "password: ENC[AES256_GCM,data:abc,iv:def,tag:ghi,type:str]\nsops:\n  mac: ENC[AES256_GCM,data:abc,iv:def,tag:ghi,type:str]\n  version: 3.9.0\n",
+	})
+	stack.valuesFiles = []string{"values.yaml"}
+	values, decrypted, err := stack.readValues(context.Background())
+	if err != nil || values["image"] != "app" || decrypted {
+		t.Errorf("unexpected values: %v, %v, %v", values, decrypted, err)
+	}
+	stack.valuesFiles = []string{"values.yaml", "secrets.yaml"}
+	_, _, err = stack.readValues(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "could not decrypt app stack values file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Compose templates include the named templates of the partials directory
+func TestRenderComposeTemplatePartials(t *testing.T) {
+	stack := newTemplateTestStack(t, nil)
+	err := os.Mkdir(path.Join(stack.repo.path, "templates"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partials := `{{ define "traefik-labels" }}traefik.enable: "true"
+traefik.http.routers.{{ .Stack.Name }}.rule: Host(` + "`{{ .Values.host }}`" + `){{ end }}`
+	err = os.WriteFile(path.Join(stack.repo.path, "templates", "_helpers.tpl"), []byte(partials), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack.templatesDir = "templates"
+	stack.values = map[string]any{"host": "app.example.com"}
+	template := "labels:\n{{ include \"traefik-labels\" . | indent 2 }}\n"
+	rendered, err := renderTestTemplate(stack, []byte(template))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "labels:\n  traefik.enable: \"true\"\n  traefik.http.routers.app.rule: Host(`app.example.com`)\n"
+	if string(rendered) != expected {
+		t.Errorf("unexpected rendered template: %q", rendered)
+	}
+
+	_, err = renderTestTemplate(stack, []byte(`{{ define "loop" }}{{ include "loop" . }}{{ end }}{{ include "loop" . }}`))
+	if err == nil || !strings.Contains(err.Error(), "nested more than") {
+		t.Errorf("unexpected error of recursive include: %v", err)
+	}
+}
+
+// Configs and secrets marked as templates are rendered in place before being rotated
+func TestRenderObjectTemplates(t *testing.T) {
+	stack := newTemplateTestStack(t, map[string]string{
+		"nginx.conf.tmpl": "server_name {{ .Values.host }};\n",
+		"app.env":         "HOST={{ .Values.host }}\n",
+		"static.conf":     "{{ not rendered }}\n",
+	})
+	stack.values = map[string]any{"host": "app.example.com"}
+	composeMap, err := stack.parseStackString([]byte(`configs:
+  nginx:
+    file: nginx.conf.tmpl
+  static:
+    file: static.conf
+secrets:
+  app:
+    file: app.env
+    template: true`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectFiles, err := templatedObjects(composeMap, stack.composePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(objectFiles) != 2 || objectFiles[0] != "app.env" || objectFiles[1] != "nginx.conf.tmpl" {
+		t.Errorf("unexpected templates: %v", objectFiles)
+	}
+	if _, ok := composeMap["secrets"].(map[string]any)["app"].(map[string]any)["template"]; ok {
+		t.Errorf("template key was not removed from the compose file")
+	}
+	data, _, _ := stack.templateData(context.Background(), "abcdef12")
+	// rendered files are written to disk, decrypted values must not be
+	err = stack.renderObjectTemplates(objectFiles, data, true, logger)
+	if err == nil || !strings.Contains(err.Error(), "cannot use encrypted values files") {
+		t.Errorf("unexpected error of templates with decrypted values: %v", err)
+	}
+	rendered, _ := os.ReadFile(path.Join(stack.repo.path, "nginx.conf.tmpl"))
+	if strings.Contains(string(rendered), "app.example.com") {
+		t.Errorf("template was rendered with decrypted values: %q", rendered)
+	}
+	err = stack.renderObjectTemplates(objectFiles, data, false, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rendered, _ = os.ReadFile(path.Join(stack.repo.path, "nginx.conf.tmpl"))
+	if string(rendered) != "server_name app.example.com;\n" {
+		t.Errorf("unexpected rendered config: %q", rendered)
+	}
+	rendered, _ = os.ReadFile(path.Join(stack.repo.path, "app.env"))
+	if string(rendered) != "HOST=app.example.com\n" {
+		t.Errorf("unexpected rendered secret: %q", rendered)
+	}
+	rendered, _ = os.ReadFile(path.Join(stack.repo.path, "static.conf"))
+	if string(rendered) != "{{ not rendered }}\n" {
+		t.Errorf("unexpected config: %q", rendered)
+	}
+}
@@ -0,0 +1,76 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/m-adawi/swarm-cd/swarmcd"
+
+// tracer is a no-op until tracing is configured
+var tracer trace.Tracer = otel.Tracer(tracerName)
+
+var tracerProvider *sdktrace.TracerProvider
+
+// initTracing exports spans to the configured OTLP endpoint.
+// The provider is registered globally so that the HTTP
+// handlers spans are exported along with the sync spans
+func initTracing() error {
+	if config.Tracing == nil || config.Tracing.Endpoint == "" {
+		return nil
+	}
+	var exporterOptions []otlptracehttp.Option
+	if strings.Contains(config.Tracing.Endpoint, "://") {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithEndpointURL(config.Tracing.Endpoint))
+	} else {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithEndpoint(config.Tracing.Endpoint))
+	}
+	if config.Tracing.Insecure {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), exporterOptions...)
+	if err != nil {
+		return fmt.Errorf("could not create OTLP trace exporter: %w", err)
+	}
+	tracerResource, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("swarm-cd"),
+	))
+	if err != nil {
+		return fmt.Errorf("could not create tracing resource: %w", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(tracerResource),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracer = tracerProvider.Tracer(tracerName)
+	return nil
+}
+
+// ShutdownTracing exports the remaining spans
+func ShutdownTracing(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
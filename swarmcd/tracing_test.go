@@ -0,0 +1,67 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Each stage is a child span of the stack update, failed stages are marked as errors
+func TestUpdateStackSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previousTracer := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+	defer func() { tracer = previousTracer }()
+
+	store, err := openHistoryStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer store.db.Close()
+	history = store
+	events = newEventBroker(10)
+	repo := &stackRepo{name: "test", lock: &sync.Mutex{}}
+	stack := newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false, false)
+	stackStatus["test"] = &StackStatus{Status: StatusUnknown}
+	defer delete(stackStatus, "test")
+
+	updateStackThread(context.Background(), stack, TriggerManual, func(ctx context.Context, log *slog.Logger, trigger Trigger) (*syncResult, error) {
+		result := &syncResult{revision: "abcdef12"}
+		result.enterStage(ctx, log, stagePull)
+		result.enterStage(ctx, log, stageRead)
+		return result, errors.New("boom")
+	})
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	updateSpan, ok := spans["update stack"]
+	if !ok {
+		t.Fatalf("update stack span not recorded")
+	}
+	for _, name := range []string{"wait for repo lock", stagePull, stageRead} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("%s span not recorded", name)
+		}
+		if span.Parent().SpanID() != updateSpan.SpanContext().SpanID() {
+			t.Errorf("unexpected parent of %s span", name)
+		}
+	}
+	if spans[stagePull].Status().Code == codes.Error {
+		t.Errorf("unexpected error status of pull span")
+	}
+	if spans[stageRead].Status().Code != codes.Error {
+		t.Errorf("unexpected status of read span: %v", spans[stageRead].Status())
+	}
+	if updateSpan.Status().Code != codes.Error {
+		t.Errorf("unexpected status of update stack span: %v", updateSpan.Status())
+	}
+}
@@ -0,0 +1,48 @@
+package swarmcd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrWebhookDisabled = errors.New("webhook is disabled, set the webhook_secret of the repo to enable it")
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// VerifyWebhook checks that a push webhook of a repo was sent by its
+// git server, from the HMAC signature of the body sent by GitHub and
+// Gitea or from the secret token sent by GitLab
+func VerifyWebhook(repoName string, header http.Header, body []byte) error {
+	repo, ok := repos[repoName]
+	if !ok {
+		return ErrRepoNotFound
+	}
+	if repo.webhookSecret == "" {
+		return ErrWebhookDisabled
+	}
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(repo.webhookSecret)) != 1 {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	signature, found := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+	if !found {
+		signature = header.Get("X-Gitea-Signature")
+	}
+	signatureBytes, err := hex.DecodeString(signature)
+	if err != nil || signature == "" {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(repo.webhookSecret))
+	mac.Write(body)
+	if !hmac.Equal(signatureBytes, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
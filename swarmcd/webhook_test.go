@@ -0,0 +1,41 @@
+package swarmcd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	repos["webhook-test"] = &stackRepo{name: "webhook-test", webhookSecret: "s3cr3t"}
+	repos["webhook-disabled"] = &stackRepo{name: "webhook-disabled"}
+	defer delete(repos, "webhook-test")
+	defer delete(repos, "webhook-disabled")
+	body := []byte(`{"ref": "refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	for name, test := range map[string]struct {
+		repo   string
+		header http.Header
+		err    error
+	}{
+		"github":            {"webhook-test", http.Header{"X-Hub-Signature-256": {"sha256=" + signature}}, nil},
+		"gitea":             {"webhook-test", http.Header{"X-Gitea-Signature": {signature}}, nil},
+		"gitlab":            {"webhook-test", http.Header{"X-Gitlab-Token": {"s3cr3t"}}, nil},
+		"invalid signature": {"webhook-test", http.Header{"X-Hub-Signature-256": {"sha256=" + signature[2:] + "00"}}, ErrInvalidSignature},
+		"invalid token":     {"webhook-test", http.Header{"X-Gitlab-Token": {"guess"}}, ErrInvalidSignature},
+		"unsigned":          {"webhook-test", http.Header{}, ErrInvalidSignature},
+		"disabled":          {"webhook-disabled", http.Header{"X-Gitlab-Token": {""}}, ErrWebhookDisabled},
+		"unknown repo":      {"missing", http.Header{}, ErrRepoNotFound},
+	} {
+		err := VerifyWebhook(test.repo, test.header, body)
+		if !errors.Is(err, test.err) {
+			t.Errorf("unexpected error of %s webhook: %v", name, err)
+		}
+	}
+}
@@ -3,7 +3,12 @@ package util
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
 
+	"github.com/goccy/go-yaml"
 	"github.com/spf13/viper"
 )
 
@@ -11,26 +16,138 @@ type StackConfig struct {
 	Repo                 string
 	Branch               string
 	ComposeFile          string   `mapstructure:"compose_file"`
+	ComposeFiles         []string `mapstructure:"compose_files"`
+	Overlay              string
+	Renderer             string
 	ValuesFile           string   `mapstructure:"values_file"`
+	ValuesFiles          []string `mapstructure:"values_files"`
+	EncryptedValuesFiles []string `mapstructure:"encrypted_values_files"`
+	Values               map[string]any
+	TemplatesDir         string `mapstructure:"templates_dir"`
+	Env                  map[string]string
+	EnvFiles             []string `mapstructure:"env_files"`
 	SopsFiles            []string `mapstructure:"sops_files"`
 	SopsSecretsDiscovery bool     `mapstructure:"sops_secrets_discovery"`
+	SelfHeal             bool     `mapstructure:"self_heal"`
+	StrictTemplates      bool     `mapstructure:"strict_templates"`
+	UpdateInterval       int      `mapstructure:"update_interval"`
+	Project              string
+	DependsOn            []string `mapstructure:"depends_on"`
+	Hooks                []*HookConfig
+}
+
+// HookConfig is a hook job of a stack, run
+// once before or after the stack is deployed
+type HookConfig struct {
+	Name        string
+	Hook        string
+	Image       string
+	Command     []string
+	Environment []string
+	Networks    []string
+}
+
+// RendererConfig is a command that writes the
+// compose file of the stacks that use it to stdout
+type RendererConfig struct {
+	Command []string
+}
+
+type CommitStatusConfig struct {
+	Provider  string
+	ApiUrl    string `mapstructure:"api_url"`
+	Token     string
+	TokenFile string `mapstructure:"token_file"`
 }
 
 type RepoConfig struct {
+	Url               string
+	Username          string
+	Password          string
+	PasswordFile      string              `mapstructure:"password_file"`
+	CommitStatus      *CommitStatusConfig `mapstructure:"commit_status"`
+	UpdateInterval    int                 `mapstructure:"update_interval"`
+	TemplatesDir      string              `mapstructure:"templates_dir"`
+	WebhookSecret     string              `mapstructure:"webhook_secret"`
+	WebhookSecretFile string              `mapstructure:"webhook_secret_file"`
+}
+
+type NotificationConfig struct {
+	Name         string
+	Type         string
 	Url          string
+	Headers      map[string]string
+	Body         string
+	Stacks       []string
+	Events       []string
+	SmtpHost     string `mapstructure:"smtp_host"`
+	SmtpPort     int    `mapstructure:"smtp_port"`
 	Username     string
 	Password     string
 	PasswordFile string `mapstructure:"password_file"`
+	From         string
+	To           []string
+}
+
+type TracingConfig struct {
+	Endpoint string
+	Insecure bool
+}
+
+// TimeoutsConfig is the timeouts of the update stages in seconds
+type TimeoutsConfig struct {
+	Git      int
+	Render   int
+	Decrypt  int
+	Deploy   int
+	Hook     int
+	Renderer int
+}
+
+type RetryConfig struct {
+	Attempts       int
+	InitialBackoff int `mapstructure:"initial_backoff"`
+	MaxBackoff     int `mapstructure:"max_backoff"`
+}
+
+type SyncWindowConfig struct {
+	Name       string
+	Kind       string
+	Schedule   string
+	Duration   string
+	TimeZone   string `mapstructure:"time_zone"`
+	Stacks     []string
+	Projects   []string
+	ManualSync bool `mapstructure:"manual_sync"`
 }
 
 type Config struct {
-	ReposPath            string                  `mapstructure:"repos_path"`
-	UpdateInterval       int                     `mapstructure:"update_interval"`
-	AutoRotate           bool                    `mapstructure:"auto_rotate"`
-	StackConfigs         map[string]*StackConfig `mapstructure:"stacks"`
-	RepoConfigs          map[string]*RepoConfig  `mapstructure:"repos"`
-	SopsSecretsDiscovery bool                    `mapstructure:"sops_secrets_discovery"`
-	Address              string                  `mapstructure:"address"`
+	ReposPath            string                     `mapstructure:"repos_path"`
+	UpdateInterval       int                        `mapstructure:"update_interval"`
+	HeartbeatTimeout     int                        `mapstructure:"heartbeat_timeout"`
+	Workers              int                        `mapstructure:"workers"`
+	ShutdownGracePeriod  int                        `mapstructure:"shutdown_grace_period"`
+	AutoRotate           bool                       `mapstructure:"auto_rotate"`
+	StackConfigs         map[string]*StackConfig    `mapstructure:"stacks"`
+	RepoConfigs          map[string]*RepoConfig     `mapstructure:"repos"`
+	SopsSecretsDiscovery bool                       `mapstructure:"sops_secrets_discovery"`
+	Address              string                     `mapstructure:"address"`
+	AdminToken           string                     `mapstructure:"admin_token"`
+	AdminTokenFile       string                     `mapstructure:"admin_token_file"`
+	ExternalUrl          string                     `mapstructure:"external_url"`
+	LogFormat            string                     `mapstructure:"log_format"`
+	LogLevel             string                     `mapstructure:"log_level"`
+	EventsBufferSize     int                        `mapstructure:"events_buffer_size"`
+	SelfHeal             bool                       `mapstructure:"self_heal"`
+	StrictTemplates      bool                       `mapstructure:"strict_templates"`
+	StatePath            string                     `mapstructure:"state_path"`
+	HistoryLimit         int                        `mapstructure:"history_limit"`
+	Notifications        []*NotificationConfig      `mapstructure:"notifications"`
+	Renderers            map[string]*RendererConfig `mapstructure:"renderers"`
+	Tracing              *TracingConfig             `mapstructure:"tracing"`
+	Timeouts             TimeoutsConfig             `mapstructure:"timeouts"`
+	Retry                RetryConfig                `mapstructure:"retry"`
+	SyncWindows          []*SyncWindowConfig        `mapstructure:"sync_windows"`
 }
 
 var Configs Config
@@ -40,6 +157,10 @@ func LoadConfigs() (err error) {
 	if err != nil {
 		return fmt.Errorf("could not read configuration file: %w", err)
 	}
+	err = configureLogger(Configs.LogFormat, Configs.LogLevel)
+	if err != nil {
+		return err
+	}
 	if Configs.RepoConfigs == nil {
 		err = readRepoConfigs()
 		if err != nil {
@@ -52,23 +173,91 @@ func LoadConfigs() (err error) {
 			return fmt.Errorf("could not load stacks file: %w", err)
 		}
 	}
+	_, err = StackOrder(Configs.StackConfigs)
 	return
 }
 
+// StackOrder sorts stacks so that every stack comes after the stacks
+// it depends on, and by name otherwise. Returns an error if a stack
+// depends on an unknown stack or if dependencies form a cycle
+func StackOrder(stackConfigs map[string]*StackConfig) ([]string, error) {
+	dependents := map[string][]string{}
+	remaining := map[string]int{}
+	for stack, stackConfig := range stackConfigs {
+		remaining[stack] = len(stackConfig.DependsOn)
+		for _, dependency := range stackConfig.DependsOn {
+			if _, ok := stackConfigs[dependency]; !ok {
+				return nil, fmt.Errorf("stack %s depends on unknown stack %s", stack, dependency)
+			}
+			dependents[dependency] = append(dependents[dependency], stack)
+		}
+	}
+	var ready []string
+	for stack, count := range remaining {
+		if count == 0 {
+			ready = append(ready, stack)
+		}
+	}
+	var order []string
+	for len(ready) != 0 {
+		slices.Sort(ready)
+		stack := ready[0]
+		ready = ready[1:]
+		order = append(order, stack)
+		for _, dependent := range dependents[stack] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(order) != len(stackConfigs) {
+		var cycle []string
+		for stack, count := range remaining {
+			if count != 0 {
+				cycle = append(cycle, stack)
+			}
+		}
+		slices.Sort(cycle)
+		return nil, fmt.Errorf("could not order stacks %s, their dependencies form a cycle", strings.Join(cycle, ", "))
+	}
+	return order, nil
+}
+
 func readConfig() (err error) {
 	configViper := viper.New()
 	configViper.SetConfigName("config")
 	configViper.AddConfigPath(".")
 	configViper.SetDefault("update_interval", 120)
+	configViper.SetDefault("workers", 4)
+	configViper.SetDefault("shutdown_grace_period", 30)
 	configViper.SetDefault("repos_path", "repos")
 	configViper.SetDefault("auto_rotate", true)
 	configViper.SetDefault("sops_secrets_discovery", false)
+	configViper.SetDefault("self_heal", false)
+	configViper.SetDefault("strict_templates", false)
 	configViper.SetDefault("address", "0.0.0.0:8080")
+	configViper.SetDefault("log_format", "text")
+	configViper.SetDefault("events_buffer_size", 100)
+	configViper.SetDefault("history_limit", 1000)
+	configViper.SetDefault("timeouts.git", 120)
+	configViper.SetDefault("timeouts.render", 30)
+	configViper.SetDefault("timeouts.decrypt", 60)
+	configViper.SetDefault("timeouts.deploy", 600)
+	configViper.SetDefault("timeouts.hook", 600)
+	configViper.SetDefault("timeouts.renderer", 90)
+	configViper.SetDefault("retry.attempts", 3)
+	configViper.SetDefault("retry.initial_backoff", 2)
+	configViper.SetDefault("retry.max_backoff", 60)
 	err = configViper.ReadInConfig()
 	if err != nil && !errors.As(err, &viper.ConfigFileNotFoundError{}) {
 		return
 	}
-	return configViper.Unmarshal(&Configs)
+	err = configViper.Unmarshal(&Configs)
+	if err != nil || Configs.StackConfigs == nil {
+		return
+	}
+	return readStackMaps(configViper.ConfigFileUsed(), true, Configs.StackConfigs)
 }
 
 func readRepoConfigs() (err error) {
@@ -90,5 +279,57 @@ func readStackConfigs() (err error) {
 	if err != nil {
 		return
 	}
-	return stacksViper.Unmarshal(&Configs.StackConfigs)
+	err = stacksViper.Unmarshal(&Configs.StackConfigs)
+	if err != nil {
+		return
+	}
+	return readStackMaps(stacksViper.ConfigFileUsed(), false, Configs.StackConfigs)
+}
+
+// stackMaps are the maps of a stack config whose keys are case sensitive
+type stackMaps struct {
+	Env    map[string]string `yaml:"env"`
+	Values map[string]any    `yaml:"values"`
+}
+
+// readStackMaps reads the env and the values of the stacks again from
+// the file they were loaded from, since viper lowercases the keys of
+// maps and the names of variables and values are case sensitive. The
+// stacks are under the stacks key of the config file, or at the root
+// of the stacks file
+func readStackMaps(configFile string, underStacksKey bool, stackConfigs map[string]*StackConfig) error {
+	if ext := path.Ext(configFile); ext != ".yaml" && ext != ".yml" {
+		return nil
+	}
+	configBytes, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", configFile, err)
+	}
+	var stacks map[string]stackMaps
+	if underStacksKey {
+		var config struct {
+			Stacks map[string]stackMaps `yaml:"stacks"`
+		}
+		err = yaml.Unmarshal(configBytes, &config)
+		stacks = config.Stacks
+	} else {
+		err = yaml.Unmarshal(configBytes, &stacks)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read env and values of stacks, they must be maps: %w", err)
+	}
+	for stackName, stack := range stacks {
+		// viper lowercases the names of stacks too
+		stackConfig, ok := stackConfigs[strings.ToLower(stackName)]
+		if !ok {
+			continue
+		}
+		if stack.Env != nil {
+			stackConfig.Env = stack.Env
+		}
+		if stack.Values != nil {
+			stackConfig.Values = stack.Values
+		}
+	}
+	return nil
 }
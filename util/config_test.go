@@ -0,0 +1,116 @@
+package util
+
+import (
+	"maps"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestStackOrder(t *testing.T) {
+	stackConfigs := map[string]*StackConfig{
+		"app":        {DependsOn: []string{"traefik", "monitoring"}},
+		"monitoring": {DependsOn: []string{"traefik"}},
+		"traefik":    {},
+		"blog":       {},
+	}
+	order, err := StackOrder(stackConfigs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !slices.Equal(order, []string{"blog", "traefik", "monitoring", "app"}) {
+		t.Errorf("unexpected order: %v", order)
+	}
+}
+
+func TestStackOrderErrors(t *testing.T) {
+	_, err := StackOrder(map[string]*StackConfig{
+		"app": {DependsOn: []string{"traefik"}},
+	})
+	if err == nil || err.Error() != "stack app depends on unknown stack traefik" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, err = StackOrder(map[string]*StackConfig{
+		"a":       {DependsOn: []string{"b"}},
+		"b":       {DependsOn: []string{"a"}},
+		"traefik": {},
+	})
+	if err == nil || err.Error() != "could not order stacks a, b, their dependencies form a cycle" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// The env and values of stacks keep the case of their keys
+func TestReadStackMaps(t *testing.T) {
+	stacksFile := path.Join(t.TempDir(), "stacks.yaml")
+	err := os.WriteFile(stacksFile, []byte(`MyApp:
+  repo: infra
+  env:
+    TAG: 1.2.3
+    Domain: example.com
+  values:
+    imageTag: "2.0"
+    ingress:
+      hostName: example.com
+other:
+  repo: infra
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stackConfigs := map[string]*StackConfig{
+		"myapp": {
+			Env:    map[string]string{"tag": "1.2.3", "domain": "example.com"},
+			Values: map[string]any{"imagetag": "2.0", "ingress": map[string]any{"hostname": "example.com"}},
+		},
+		"other": {},
+	}
+	err = readStackMaps(stacksFile, false, stackConfigs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !maps.Equal(stackConfigs["myapp"].Env, map[string]string{"TAG": "1.2.3", "Domain": "example.com"}) {
+		t.Errorf("unexpected env: %v", stackConfigs["myapp"].Env)
+	}
+	expectedValues := map[string]any{"imageTag": "2.0", "ingress": map[string]any{"hostName": "example.com"}}
+	if !reflect.DeepEqual(stackConfigs["myapp"].Values, expectedValues) {
+		t.Errorf("unexpected values: %#v", stackConfigs["myapp"].Values)
+	}
+	if stackConfigs["other"].Env != nil {
+		t.Errorf("unexpected env: %v", stackConfigs["other"].Env)
+	}
+
+	err = os.WriteFile(stacksFile, []byte("app:\n  env:\n    - TAG=1.2.3\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = readStackMaps(stacksFile, false, stackConfigs)
+	if err == nil {
+		t.Errorf("expected an error for a list env")
+	}
+}
+
+// Stacks defined in the config file keep the case of their env too
+func TestReadStackMapsConfigFile(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(`update_interval: 60
+stacks:
+  app:
+    repo: infra
+    env:
+      TAG: 1.2.3
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stackConfigs := map[string]*StackConfig{"app": {Env: map[string]string{"tag": "1.2.3"}}}
+	err = readStackMaps(configFile, true, stackConfigs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !maps.Equal(stackConfigs["app"].Env, map[string]string{"TAG": "1.2.3"}) {
+		t.Errorf("unexpected env: %v", stackConfigs["app"].Env)
+	}
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
 	"strings"
@@ -8,9 +9,12 @@ import (
 
 var Logger *slog.Logger
 
+// logLevel can be changed at runtime
+var logLevel = new(slog.LevelVar)
+
 func init() {
-	level := getLogLevelFromEnv()
-	logOptions := &slog.HandlerOptions{Level: level}
+	logLevel.Set(getLogLevelFromEnv())
+	logOptions := &slog.HandlerOptions{Level: logLevel}
 	Logger = slog.New(slog.NewTextHandler(os.Stderr, logOptions))
 }
 
@@ -29,3 +33,42 @@ func getLogLevelFromEnv() slog.Level {
 		return slog.LevelInfo
 	}
 }
+
+// configureLogger sets the log format and level from the
+// configuration. The level defaults to the LOG_LEVEL variable
+func configureLogger(format string, level string) error {
+	if level != "" {
+		err := SetLogLevel(level)
+		if err != nil {
+			return err
+		}
+	}
+	logOptions := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, logOptions)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, logOptions)
+	default:
+		return fmt.Errorf("invalid log format %s, must be one of json or text", format)
+	}
+	// the logger is shared by pointer across packages,
+	// so replace the logger value rather than the pointer
+	*Logger = *slog.New(handler)
+	return nil
+}
+
+func SetLogLevel(level string) error {
+	var newLevel slog.Level
+	err := newLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %s, must be one of debug, info, warn or error", level)
+	}
+	logLevel.Set(newLevel)
+	return nil
+}
+
+func GetLogLevel() string {
+	return strings.ToLower(logLevel.Level().String())
+}
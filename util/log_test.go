@@ -0,0 +1,35 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	defer SetLogLevel(GetLogLevel())
+	err := SetLogLevel("DEBUG")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if GetLogLevel() != "debug" {
+		t.Errorf("unexpected log level: %s", GetLogLevel())
+	}
+	err = SetLogLevel("verbose")
+	if err == nil {
+		t.Errorf("expected an error for an invalid log level")
+	}
+	if GetLogLevel() != "debug" {
+		t.Errorf("log level changed after an invalid level: %s", GetLogLevel())
+	}
+}
+
+func TestConfigureLoggerFormat(t *testing.T) {
+	defer configureLogger("text", "")
+	err := configureLogger("json", "")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = configureLogger("xml", "")
+	if err == nil {
+		t.Errorf("expected an error for an invalid log format")
+	}
+}
@@ -1,29 +1,40 @@
 package util
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"path/filepath"
 
 	"github.com/getsops/sops/v3/decrypt"
 )
 
-func DecryptFile(filepath string) (err error) {
-	format := getFileFormat(filepath)
-	textBytes, err := decrypt.File(filepath, format)
-	if err != nil {
-		return fmt.Errorf("could not decrypt the file %s: %w", filepath, err)
-	}
-	file, err := os.Create(filepath)
-	if err != nil {
-		return fmt.Errorf("could not open the file %s: %w", filepath, err)
+// sopsDecrypt decrypts data with sops, tests replace it
+var sopsDecrypt = decrypt.Data
+
+// DecryptData decrypts sops encrypted data in memory, the format is
+// guessed from the file name. sops calls to key services like KMS or
+// Vault take no context, so when ctx is done the decryption is given
+// up on and its result discarded once it returns
+func DecryptData(ctx context.Context, data []byte, filename string) ([]byte, error) {
+	type decryption struct {
+		textBytes []byte
+		err       error
 	}
-	defer file.Close()
-	_, err = file.Write(textBytes)
-	if err != nil {
-		return fmt.Errorf("could not write the file %s: %w", filepath, err)
+	done := make(chan decryption, 1)
+	decryptData := sopsDecrypt
+	go func() {
+		textBytes, err := decryptData(data, getFileFormat(filename))
+		done <- decryption{textBytes, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("could not decrypt the file %s: %w", filename, ctx.Err())
+	case result := <-done:
+		if result.err != nil {
+			return nil, fmt.Errorf("could not decrypt the file %s: %w", filename, result.err)
+		}
+		return result.textBytes, nil
 	}
-	return
 }
 
 func getFileFormat(filename string) string {
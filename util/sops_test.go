@@ -1,7 +1,10 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestGetFileFormat(t *testing.T) {
@@ -64,3 +67,20 @@ func TestGetFileFormat(t *testing.T) {
 		})
 	}
 }
+
+// Decryption is given up on when key services hang
+func TestDecryptDataTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	defer func(decrypt func([]byte, string) ([]byte, error)) { sopsDecrypt = decrypt }(sopsDecrypt)
+	sopsDecrypt = func(data []byte, format string) ([]byte, error) {
+		<-release
+		return data, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := DecryptData(ctx, []byte("secret: ENC[...]"), "secrets.yaml")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
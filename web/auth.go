@@ -0,0 +1,43 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// adminToken authenticates requests to the admin API,
+// which is disabled when no token is configured
+var adminToken string
+
+func loadAdminToken() error {
+	adminToken = util.Configs.AdminToken
+	if util.Configs.AdminTokenFile != "" {
+		tokenBytes, err := os.ReadFile(util.Configs.AdminTokenFile)
+		if err != nil {
+			return fmt.Errorf("could not read admin token file %s: %w", util.Configs.AdminTokenFile, err)
+		}
+		adminToken = strings.TrimSpace(string(tokenBytes))
+	}
+	return nil
+}
+
+// requireAdmin rejects requests without the admin
+// token as bearer token of their Authorization header
+func requireAdmin(ctx *gin.Context) {
+	if adminToken == "" {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled, set admin_token to enable it"})
+		return
+	}
+	token, found := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		ctx.Header("WWW-Authenticate", "Bearer")
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+}
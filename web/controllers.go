@@ -1,11 +1,20 @@
 package web
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"github.com/m-adawi/swarm-cd/swarmcd"
+	"github.com/m-adawi/swarm-cd/util"
 )
 
 func getStacks(ctx *gin.Context) {
@@ -14,13 +23,255 @@ func getStacks(ctx *gin.Context) {
 	for k, v := range stacksStatus {
 		stacks = append(stacks, map[string]string{
 			"Name": k,
+			"Status": v.Status,
 			"Error": v.Error,
 			"RepoURL": v.RepoURL,
 			"Revision": v.Revision,
+			"Reason": v.Reason,
 		})
 	}
 	sort.Slice(stacks, func(i, j int) bool {
 		return stacks[i]["Name"] < stacks[j]["Name"]
 	})
 	ctx.JSON(http.StatusOK, stacks)
-}
\ No newline at end of file
+}
+
+func getStack(ctx *gin.Context) {
+	tasksLimit, err := strconv.Atoi(ctx.DefaultQuery("tasks", "5"))
+	if err != nil || tasksLimit < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "tasks must be a non-negative integer"})
+		return
+	}
+	stack, err := swarmcd.GetStackDetail(ctx.Request.Context(), ctx.Param("name"), tasksLimit)
+	if errors.Is(err, swarmcd.ErrStackNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, stack)
+}
+
+// getEvents streams stack events as server-sent events.
+// Clients can filter by stack with ?stack=a,b and resume
+// a dropped stream by sending the Last-Event-ID header
+func getEvents(ctx *gin.Context) {
+	var stackFilter []string
+	for _, stacks := range ctx.QueryArray("stack") {
+		stackFilter = append(stackFilter, strings.Split(stacks, ",")...)
+	}
+	matches := func(event swarmcd.Event) bool {
+		return len(stackFilter) == 0 || slices.Contains(stackFilter, event.Stack)
+	}
+	var lastEventID uint64
+	if header := ctx.GetHeader("Last-Event-ID"); header != "" {
+		var err error
+		lastEventID, err = strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID header"})
+			return
+		}
+	}
+
+	subscriber, replay := swarmcd.SubscribeEvents(lastEventID)
+	defer swarmcd.UnsubscribeEvents(subscriber)
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	for _, event := range replay {
+		if matches(event) {
+			renderEvent(ctx, event)
+		}
+	}
+	ctx.Writer.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-subscriber:
+			if !ok {
+				return false
+			}
+			if matches(event) {
+				renderEvent(ctx, event)
+			}
+			return true
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			return true
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-shuttingDown:
+			return false
+		}
+	})
+}
+
+func renderEvent(ctx *gin.Context, event swarmcd.Event) {
+	ctx.Render(-1, sse.Event{
+		Id:    strconv.FormatUint(event.ID, 10),
+		Event: string(event.Type),
+		Data:  event,
+	})
+}
+
+func getStackHistory(ctx *gin.Context) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a non-negative integer"})
+		return
+	}
+	history, err := swarmcd.GetStackHistory(ctx.Param("name"), limit)
+	if errors.Is(err, swarmcd.ErrStackNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, history)
+}
+
+func syncStack(ctx *gin.Context) {
+	err := swarmcd.SyncStack(ctx.Request.Context(), ctx.Param("name"), swarmcd.TriggerManual)
+	if errors.Is(err, swarmcd.ErrStackNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, swarmcd.ErrShuttingDown) || errors.Is(err, swarmcd.ErrQueueFull) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+// overrideSyncStack updates a stack even
+// when sync windows do not allow it
+func overrideSyncStack(ctx *gin.Context) {
+	err := swarmcd.SyncStack(ctx.Request.Context(), ctx.Param("name"), swarmcd.TriggerOverride)
+	if errors.Is(err, swarmcd.ErrStackNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, swarmcd.ErrShuttingDown) || errors.Is(err, swarmcd.ErrQueueFull) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+// maxWebhookBody is the size limit of webhook payloads
+const maxWebhookBody = 25 << 20
+
+func repoWebhook(ctx *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxWebhookBody))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "could not read webhook body"})
+		return
+	}
+	err = swarmcd.VerifyWebhook(ctx.Param("name"), ctx.Request.Header, body)
+	if errors.Is(err, swarmcd.ErrRepoNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, swarmcd.ErrWebhookDisabled) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	err = swarmcd.SyncRepoStacks(ctx.Request.Context(), ctx.Param("name"), swarmcd.TriggerWebhook)
+	if errors.Is(err, swarmcd.ErrRepoNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, swarmcd.ErrShuttingDown) || errors.Is(err, swarmcd.ErrQueueFull) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+func rollbackStack(ctx *gin.Context) {
+	revision := ctx.Query("revision")
+	if revision == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "revision is required"})
+		return
+	}
+	err := swarmcd.RollbackStack(ctx.Request.Context(), ctx.Param("name"), revision)
+	if errors.Is(err, swarmcd.ErrStackNotFound) || errors.Is(err, swarmcd.ErrRevisionNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, swarmcd.ErrShuttingDown) || errors.Is(err, swarmcd.ErrQueueFull) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+func resumeStack(ctx *gin.Context) {
+	err := swarmcd.ResumeAutoSync(ctx.Request.Context(), ctx.Param("name"))
+	if errors.Is(err, swarmcd.ErrStackNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, swarmcd.ErrShuttingDown) || errors.Is(err, swarmcd.ErrQueueFull) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+func getLogLevel(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"level": util.GetLogLevel()})
+}
+
+func setLogLevel(ctx *gin.Context) {
+	var body struct {
+		Level string `json:"level"`
+	}
+	err := ctx.ShouldBindJSON(&body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "body must be a JSON object with a level"})
+		return
+	}
+	err = util.SetLogLevel(body.Level)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	util.Logger.Info("log level changed", "level", util.GetLogLevel())
+	ctx.JSON(http.StatusOK, gin.H{"level": util.GetLogLevel()})
+}
+
+func getLiveness(ctx *gin.Context) {
+	checks, healthy := swarmcd.CheckLiveness()
+	renderHealth(ctx, checks, healthy)
+}
+
+func getReadiness(ctx *gin.Context) {
+	checks, ready := swarmcd.CheckReadiness(ctx.Request.Context())
+	renderHealth(ctx, checks, ready)
+}
+
+func renderHealth(ctx *gin.Context, checks []swarmcd.HealthCheck, healthy bool) {
+	if !healthy {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"Status": "failing", "Checks": checks})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"Status": "ok", "Checks": checks})
+}
@@ -1,17 +1,36 @@
 package web
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/m-adawi/swarm-cd/util"
 	"github.com/pkg/errors"
 	sloggin "github.com/samber/slog-gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 var router *gin.Engine = gin.New()
 
 func init() {
 	router.Use(sloggin.New(util.Logger))
+	// the global tracer provider delegates to the
+	// one set up later when tracing is initialized
+	router.Use(otelgin.Middleware("swarm-cd"))
 	router.GET("/stacks", getStacks)
+	router.GET("/stacks/:name", getStack)
+	router.GET("/stacks/:name/history", getStackHistory)
+	router.POST("/stacks/:name/sync", requireAdmin, syncStack)
+	router.POST("/stacks/:name/rollback", requireAdmin, rollbackStack)
+	router.POST("/stacks/:name/resume", requireAdmin, resumeStack)
+	router.POST("/repos/:name/webhook", repoWebhook)
+	router.GET("/events", getEvents)
+	router.GET("/healthz", getLiveness)
+	router.GET("/readyz", getReadiness)
+	router.GET("/admin/log-level", requireAdmin, getLogLevel)
+	router.PUT("/admin/log-level", requireAdmin, setLogLevel)
+	router.POST("/admin/stacks/:name/sync", requireAdmin, overrideSyncStack)
 	router.StaticFile("/ui", "ui/index.html")
 	router.Static("/assets", "ui/assets")
 	router.GET("/", func(c *gin.Context) {
@@ -19,10 +38,31 @@ func init() {
 	})
 }
 
+var server *http.Server
+
+// shuttingDown is closed when the server shuts down
+// to end long-lived responses like the events stream
+var shuttingDown = make(chan struct{})
+
 func RunServer(address string) error {
-	if err := router.Run(address); err != nil {
+	err := loadAdminToken()
+	if err != nil {
+		return err
+	}
+	server = &http.Server{Addr: address, Handler: router}
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+	if err = server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		util.Logger.Error("router run", "address", address)
 		return errors.Wrap(err, "router run")
 	}
 	return nil
 }
+
+// Shutdown stops accepting requests and waits
+// for in-flight requests until ctx is done
+func Shutdown(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}